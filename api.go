@@ -1,14 +1,13 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	golib "github.com/kiyor/golib"
@@ -47,7 +46,24 @@ func NewResp(w http.ResponseWriter, data interface{}, durs []time.Duration, code
 	return b
 }
 
-func NewCacheResp(w http.ResponseWriter, data interface{}, cacheKey string, expire time.Duration, code ...int) []byte {
+// NewStatusResp write resp with http status, Code is the same as status
+func NewStatusResp(w http.ResponseWriter, status int, data interface{}) []byte {
+	b, err := json.Marshal(&Resp{
+		Code: status,
+		Data: data,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	w.Write(b)
+	return b
+}
+
+// NewCacheResp write resp and cache it, dep is path the resp depend on
+func NewCacheResp(w http.ResponseWriter, data interface{}, cache *lib.Namespace[[]byte], cacheKey, dep string, code ...int) []byte {
 	c := 0
 	if len(code) > 0 {
 		c = code[0]
@@ -63,7 +79,7 @@ func NewCacheResp(w http.ResponseWriter, data interface{}, cacheKey string, expi
 	}
 	w.Header().Add("content-type", "application/json")
 	w.Write(b)
-	lib.Cache.SetWithExpire(cacheKey, b, expire)
+	cache.Set(cacheKey, b, dep)
 	return b
 }
 
@@ -86,22 +102,30 @@ func NewDir() *Dir {
 }
 
 type File struct {
-	Name     string
-	Path     string
-	Hash     string
-	Size     int64
-	SizeH    string
-	IsDir    bool
-	IsImage  bool
-	ModTime  time.Time
-	ModTimeH string
+	Name      string
+	Path      string
+	Hash      string
+	Size      int64
+	SizeH     string
+	SizeState string // exact, stale or pending of dir size
+	IsDir     bool
+	IsImage   bool
+	ModTime   time.Time
+	ModTimeH  string
+	Integrity string   // ok, mismatch or corrupt of last scrub
+	Torrent   *Torrent // status in download client, nil if not torrent
 
 	ShortCut string
+	PlayList string
 
 	ThumbLink   string
 	Description string
 	Tags        []string
 
+	Watched   bool
+	Progress  float64
+	Unwatched int
+
 	Meta kfs.MetaInfo
 }
 
@@ -132,6 +156,17 @@ func api(w http.ResponseWriter, r *http.Request) {
 
 	q := r.URL.Query()
 	action := q.Get("action")
+	limit := "api"
+	if action == "torrent_add" {
+		// base64 of large .torrent is over body limit of api
+		limit = "torrent"
+	}
+	release, ok := rateLimit(w, r, limit)
+	if !ok {
+		return
+	}
+	defer release()
+
 	switch action {
 	case "list":
 		apiList(w, r)
@@ -143,6 +178,32 @@ func api(w http.ResponseWriter, r *http.Request) {
 		apiOperation(w, r)
 	case "df":
 		apiDf(w, r)
+	case "df_history":
+		apiDfHistory(w, r)
+	case "progress":
+		apiProgress(w, r)
+	case "share":
+		apiShare(w, r)
+	case "user":
+		apiUser(w, r)
+	case "token":
+		apiToken(w, r)
+	case "audit":
+		apiAudit(w, r)
+	case "cache":
+		apiCache(w, r)
+	case "du":
+		apiDu(w, r)
+	case "integrity":
+		apiIntegrity(w, r)
+	case "torrents":
+		apiTorrents(w, r)
+	case "torrent_add":
+		apiTorrentAdd(w, r)
+	case "events":
+		apiEvents(w, r)
+	case "dupes":
+		apiDupes(w, r)
 	default:
 		w.Write([]byte("api ok"))
 	}
@@ -165,16 +226,18 @@ func init() {
 }
 
 func fetchTitle(path string) (string, error) {
-	key := "title:" + path
-	titleTasks <- golib.NewTask(
+	submit(titleTasks, golib.NewTask(
 		func() error {
-			if _, err := lib.Cache.Get(key); err == nil {
+			if appCtx.Err() != nil {
+				return nil
+			}
+			if lib.TitleCache.Has(path) {
 				return nil
 			} else {
 				if val, err := metaV2.Get(path); err == nil {
 					ctx := val.GetContext()
 					if ctx != nil && ctx["Title"] != nil {
-						lib.Cache.SetWithExpire(key, ctx["Title"].(string), 24*time.Hour)
+						lib.TitleCache.Set(path, ctx["Title"].(string), path)
 					} else {
 						name := strings.Trim(path, "/")
 						name = filepath.Base(name)
@@ -187,7 +250,7 @@ func fetchTitle(path string) (string, error) {
 							ctx["Title"] = res.Title
 							val.SetContext(ctx)
 							metaV2.Set(val)
-							lib.Cache.SetWithExpire(key, res.Title, 24*time.Hour)
+							lib.TitleCache.Set(path, res.Title, path)
 						} else {
 							log.Println(err)
 						}
@@ -199,67 +262,39 @@ func fetchTitle(path string) (string, error) {
 		},
 		nil,
 		false,
-	)
+	))
 	return "", nil
 }
 
-// size by read database
-func dirSize2(path string) (int64, error) {
-	path = strings.TrimLeft(path, "/")
-	key := "size:" + path
-	if val, err := lib.Cache.Get(key); err == nil {
-		return int64(val.(float64)), nil
-	}
-	sizeTasks <- golib.NewTask(
-		func() error {
-			if _, err := lib.Cache.Get(key); err == nil {
-				return nil
-			}
-			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
-			defer cancel()
-			size, err := metaV2.SizeWithTimeout(path, ctx)
-			if err != nil {
-				return err
-			}
-			lib.Cache.SetWithExpire(key, size, time.Hour)
-			return nil
-		},
-		nil,
-		false,
-	)
-	return 1, nil
-}
+var sizeRefresh sync.Map
 
-// size by read disk
-func dirSize(path string) (int64, error) {
-	key := "size:" + path
-	if val, err := lib.Cache.Get(key); err == nil {
-		return val.(int64), nil
+// dirSize return size of dir relative to root and its state, refresh index
+// of dir in background if size stale or pending
+func dirSize(path string, modTime time.Time) (int64, string) {
+	path = strings.Trim(path, "/")
+	size, state := metaV2.SizeState(path, modTime)
+	if state == lib.SizeExact {
+		return size, state
 	}
-	sizeTasks <- golib.NewTask(
+	if _, loaded := sizeRefresh.LoadOrStore(path, true); loaded {
+		return size, state
+	}
+	submit(sizeTasks, golib.NewTask(
 		func() error {
-			if _, err := lib.Cache.Get(key); err == nil {
+			defer sizeRefresh.Delete(path)
+			if appCtx.Err() != nil {
 				return nil
 			}
-			var size int64
-			err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-				if !info.IsDir() {
-					size += info.Size()
-				}
+			// file removed outside k2fs only found by orphan check
+			if err := metaV2.RemoveOrphan(path); err != nil {
 				return err
-			})
-			if err == nil {
-				lib.Cache.SetWithExpire(key, size, time.Hour)
 			}
-			return err
+			return metaV2.Index(path)
 		},
 		nil,
 		false,
-	)
-	return 1, nil
+	))
+	return size, state
 }
 
 func prettyTime(t time.Time) string {
@@ -1,6 +1,7 @@
 var _pathname = decodeURI(window.location.pathname); // Returns path only (/path/example.html)
 var _url = window.location.href; // Returns full URL (https://example.com/path/example.html)
 var _origin = window.location.origin; // Returns base URL (https://example.com)
+var _events = null; // event stream of current path
 
 var _getDir = function(path) {
     var p = path.split(/[\/]+/);
@@ -125,6 +126,7 @@ const myapp = {
             history: [],
             limit: 200,
             page: 1,
+            unwatched: false,
             openWith: localStorage.getItem('openWith') || 'browser', // Default to 'browser'
             localStore: localStorage.getItem('localStore') || true, // Default to 'browser'
         }
@@ -179,9 +181,35 @@ const myapp = {
                 this.getDf();
             }
         });
+        this.openEvents();
         //     console.log(this.history); 
     },
+    watch: {
+        path() {
+            this.openEvents();
+        },
+    },
     methods: {
+        // refresh on change under current dir instead of polling, reopen
+        // when dir changed
+        openEvents() {
+            if (!window.EventSource) {
+                return;
+            }
+            if (_events) {
+                _events.close();
+            }
+            let refresh = null;
+            _events = new EventSource("/events?path=" + encodeURIComponent(this.path));
+            ["file.created", "file.changed", "file.removed", "file.trashed", "file.purged", "file.restored", "file.moved",
+                "label.changed", "download.done", "torrent.added"].forEach(t => {
+                _events.addEventListener(t, () => {
+                    clearTimeout(refresh);
+                    refresh = setTimeout(() => this.listApi(), 1000);
+                });
+            });
+            _events.addEventListener("disk.alert", () => this.getDf());
+        },
         changeOpenWith(value) {
             console.log(value);
             localStorage.setItem('openWith', value);
@@ -400,6 +428,64 @@ const myapp = {
                     console.log(error)
                 })
         },
+        addTorrent(data) {
+            data.path = this.path;
+            axios.post("/api?action=torrent_add", data)
+                .then(response => {
+                    console.log(response.data);
+                    if (response.data.Code !== 0) {
+                        alert(response.data.Data);
+                    }
+                })
+                .catch(error => {
+                    console.log(error)
+                })
+        },
+        addMagnet() {
+            var magnet = window.prompt("magnet link, download to " + this.path, "");
+            if (!magnet) {
+                return
+            }
+            this.addTorrent({ magnet: magnet });
+        },
+        addTorrentFile(event) {
+            for (let f of event.target.files) {
+                let reader = new FileReader();
+                reader.onload = () => {
+                    // data url, content after comma is base64
+                    this.addTorrent({ torrent: reader.result.split(",")[1] });
+                };
+                reader.readAsDataURL(f);
+            }
+            event.target.value = "";
+        },
+        share() {
+            var expire = window.prompt("expire in (like 24h, empty is never)", "24h");
+            if (expire === null) {
+                return
+            }
+            for (let k in this.select) {
+                if (!this.select[k]) {
+                    continue
+                }
+                var data = {};
+                data.action = "create";
+                data.path = this.path.trimRight("/") + "/" + k;
+                data.expire = expire;
+                axios.post("/api?action=share", data)
+                    .then(response => {
+                        console.log(response.data);
+                        if (response.data.Code === 0) {
+                            window.prompt(k, response.data.Data.link);
+                        } else {
+                            alert(response.data.Data);
+                        }
+                    })
+                    .catch(error => {
+                        console.log(error)
+                    })
+            }
+        },
         easyLoadPic(sub) {
             this.thumbHistory.push("img_" + sub.Hash);
             let thname = document.getElementById("thname").getBoundingClientRect().left;
@@ -604,6 +690,7 @@ const myapp = {
             data.localStore = this.localStore;
             data.limit = this.limit;
             data.page = this.page;
+            data.unwatched = this.unwatched;
             await axios.post("/api?action=list", data)
                 .then(response => {
                     this.resp = response.data.Data;
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// newAudit return entry of request, save it by audit after operation done
+func newAudit(r *http.Request, via, action, path string) *lib.AuditEntry {
+	return &lib.AuditEntry{
+		Time:   time.Now(),
+		User:   currentUser(r),
+		Remote: r.RemoteAddr,
+		Via:    via,
+		Action: action,
+		Path:   path,
+	}
+}
+
+func audit(e *lib.AuditEntry, err error) {
+	if err := metaV2.Audit(e, err); err != nil {
+		log.Println("audit", err)
+	}
+}
+
+// AuditRequest audit api request, time in RFC3339
+type AuditRequest struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	User  string `json:"user"`
+	Path  string `json:"path"`
+	Limit int    `json:"limit"`
+}
+
+func apiAudit(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req AuditRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	if u := requestUser(r); u != nil && !u.IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+	q := lib.AuditQuery{
+		User:  req.User,
+		Path:  req.Path,
+		Limit: req.Limit,
+	}
+	if len(req.From) > 0 {
+		t, err := time.Parse(time.RFC3339, req.From)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		q.From = &t
+	}
+	if len(req.To) > 0 {
+		t, err := time.Parse(time.RFC3339, req.To)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		q.To = &t
+	}
+	list, err := metaV2.ListAudit(q)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	NewResp(w, list, nil)
+}
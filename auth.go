@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/kiyor/k2fs/lib"
+)
+
+var (
+	//go:embed login.html
+	loginTmpl string
+)
+
+type ctxKey int
+
+const (
+	ctxUser ctxKey = iota
+)
+
+const (
+	sessionUserKey = "user"
+	sessionCredKey = "cred"
+)
+
+// path can be accessed without login
+var publicPath = []string{
+	"/login",
+	"/logout",
+	"/favicon.ico",
+	"/bootstrap.css",
+	"/ca.crt",
+}
+var publicPrefix = []string{
+	"/.local/",
+	"/s/",
+}
+
+func isPublic(path string) bool {
+	for _, v := range publicPath {
+		if path == v {
+			return true
+		}
+	}
+	for _, v := range publicPrefix {
+		if strings.HasPrefix(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// initUsers create admin user if auth enabled and no user exist,
+// password from env ADMIN_PASSWORD or random
+func initUsers() {
+	if !flagAuth {
+		return
+	}
+	count, err := metaV2.CountUsers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if count > 0 {
+		return
+	}
+	password := os.Getenv("ADMIN_PASSWORD")
+	if len(password) == 0 {
+		password = hex.EncodeToString(securecookie.GenerateRandomKey(8))
+		log.Println("generate password of user admin:", password)
+	}
+	u := &lib.User{
+		Name: "admin",
+		Role: lib.RoleAdmin,
+	}
+	err = u.SetPassword(password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = metaV2.CreateUser(u)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("create user admin")
+}
+
+type AuthHandler struct {
+}
+
+func NewAuthHandler() *AuthHandler {
+	return &AuthHandler{}
+}
+
+// userFromRequest return user of session cookie, bearer token, basic or digest auth
+func userFromRequest(r *http.Request) (*lib.User, error) {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		u, _, err := metaV2.GetTokenUser(strings.TrimPrefix(authorization, "Bearer "))
+		return u, err
+	}
+	if strings.HasPrefix(authorization, "Digest ") {
+		return digestUser(r)
+	}
+	if r.URL.Query().Has("sig") {
+		if u, err := signedUser(r); err == nil {
+			return u, nil
+		}
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		u, err := metaV2.GetUser(name)
+		if err != nil {
+			return nil, errors.New("invalid user or password")
+		}
+		// bcrypt is slow, remember verified credential for a while, stored
+		// hash in key so it is dropped when password changed or user deleted
+		sum := sha256.Sum256([]byte(name + ":" + password + ":" + u.PasswordHash))
+		key := hex.EncodeToString(sum[:])
+		if lib.AuthCache.Has(key) {
+			return u, nil
+		}
+		if u, err = metaV2.Login(name, password); err != nil {
+			return nil, err
+		}
+		lib.AuthCache.Set(key, u.Name)
+		return u, nil
+	}
+	session, _ := store.Get(r, APP)
+	if name, ok := session.Values[sessionUserKey].(string); ok && len(name) > 0 {
+		u, err := metaV2.GetUser(name)
+		if err != nil {
+			return nil, err
+		}
+		if cred, _ := session.Values[sessionCredKey].(string); cred != u.CredVersion() {
+			return nil, errors.New("session expired")
+		}
+		return u, nil
+	}
+	return nil, errors.New("not login")
+}
+
+func (a *AuthHandler) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !flagAuth {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, err := userFromRequest(r)
+		if err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), ctxUser, u))
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		unauthorized(w, r, err)
+	})
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api"):
+		NewStatusResp(w, http.StatusUnauthorized, "unauthorized")
+	case strings.HasPrefix(r.URL.Path, "/webdav"):
+		w.Header().Add("WWW-Authenticate", digestChallenge(errors.Is(err, errDigestStale)))
+		w.Header().Add("WWW-Authenticate", `Basic realm="`+lib.DigestRealm+`"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	default:
+		http.Redirect(w, r, "/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusFound)
+	}
+}
+
+// requestUser return login user, nil if auth disabled
+func requestUser(r *http.Request) *lib.User {
+	u, _ := r.Context().Value(ctxUser).(*lib.User)
+	return u
+}
+
+// currentUser return name of login user, empty if auth disabled
+func currentUser(r *http.Request) string {
+	if u := requestUser(r); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+type Login struct {
+	Next  string
+	Error string
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request) {
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	l := &Login{Next: next}
+	if r.Method == http.MethodPost {
+		u, err := metaV2.Login(r.FormValue("name"), r.FormValue("password"))
+		if err == nil {
+			session, _ := store.Get(r, APP)
+			session.Values[sessionUserKey] = u.Name
+			session.Values[sessionCredKey] = u.CredVersion()
+			err = session.Save(r, w)
+			if err == nil {
+				log.Println("login", u.Name, r.RemoteAddr)
+				http.Redirect(w, r, next, http.StatusFound)
+				return
+			}
+		}
+		log.Println("login failed", r.FormValue("name"), r.RemoteAddr, err)
+		l.Error = err.Error()
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	t := template.Must(template.New("login").Parse(loginTmpl))
+	t.Execute(w, l)
+}
+
+func renderLogout(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, APP)
+	delete(session.Values, sessionUserKey)
+	delete(session.Values, sessionCredKey)
+	session.Options.MaxAge = -1
+	err := session.Save(r, w)
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// UserRequest user api request
+type UserRequest struct {
+	Action   string      `json:"action"` // list, create, update, delete, passwd
+	Name     string      `json:"name"`
+	Password string      `json:"password"`
+	Role     string      `json:"role"`
+	Root     string      `json:"root"`
+	Grants   []lib.Grant `json:"grants"`
+}
+
+func validRole(role string) bool {
+	return lib.ParsePerm(role) > lib.PermNone || role == lib.PermNone.String()
+}
+
+func apiUser(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req UserRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	me := requestUser(r)
+	if me == nil {
+		NewResp(w, "auth disabled", nil, 1)
+		return
+	}
+	// token can not manage user, read token would reset password of owner
+	if me.Scope > lib.PermNone {
+		NewStatusResp(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	// non admin can only change own password
+	if !me.IsAdmin() && !(req.Action == "passwd" && (req.Name == me.Name || len(req.Name) == 0)) {
+		NewStatusResp(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	switch req.Action {
+	case "list":
+		list, err := metaV2.ListUsers()
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, list, nil)
+	case "create":
+		if len(req.Role) > 0 && !validRole(req.Role) {
+			NewResp(w, "unknown role "+req.Role, nil, 1)
+			return
+		}
+		u := &lib.User{
+			Name: req.Name,
+			Role: req.Role,
+			Root: strings.Trim(req.Root, "/"),
+		}
+		err := u.SetPassword(req.Password)
+		if err == nil {
+			err = u.SetGrants(req.Grants)
+		}
+		if err == nil {
+			err = metaV2.CreateUser(u)
+		}
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, u, nil)
+	case "update":
+		u, err := metaV2.GetUser(req.Name)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		if len(req.Role) > 0 {
+			if !validRole(req.Role) {
+				NewResp(w, "unknown role "+req.Role, nil, 1)
+				return
+			}
+			u.Role = req.Role
+		}
+		if len(req.Root) > 0 {
+			u.Root = strings.Trim(req.Root, "/")
+		}
+		if req.Grants != nil {
+			err = u.SetGrants(req.Grants)
+		}
+		if err == nil {
+			err = metaV2.SaveUser(u)
+		}
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, u, nil)
+	case "delete":
+		if req.Name == me.Name {
+			NewResp(w, "can not delete yourself", nil, 1)
+			return
+		}
+		err := metaV2.DeleteUser(req.Name)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, "success", nil)
+	case "passwd":
+		name := req.Name
+		if len(name) == 0 {
+			name = me.Name
+		}
+		u, err := metaV2.GetUser(name)
+		if err == nil {
+			err = u.SetPassword(req.Password)
+		}
+		if err == nil {
+			err = metaV2.SaveUser(u)
+		}
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, "success", nil)
+	default:
+		NewResp(w, "unknown user action "+req.Action, nil, 1)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// parseCacheNS parse flag like size:size=20000,ttl=1h
+func parseCacheNS(s string) error {
+	name, args, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("invalid cache namespace %q", s)
+	}
+	var size int
+	var ttl time.Duration
+	for _, st := range lib.ListCacheStats() {
+		if st.Name == name {
+			size = st.Size
+			ttl, _ = time.ParseDuration(st.TTL)
+		}
+	}
+	for _, v := range strings.Split(args, ",") {
+		k, val, _ := strings.Cut(v, "=")
+		var err error
+		switch k {
+		case "size":
+			size, err = strconv.Atoi(val)
+		case "ttl":
+			ttl, err = time.ParseDuration(val)
+		default:
+			err = fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return fmt.Errorf("cache %s: %w", name, err)
+		}
+	}
+	return lib.SetNamespace(name, size, ttl)
+}
+
+// CacheRequest cache api request
+type CacheRequest struct {
+	Action string `json:"action"` // stats or purge
+	Path   string `json:"path"`   // purge entry depend on path, all if empty
+}
+
+func apiCache(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req CacheRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	if u := requestUser(r); u != nil && !u.IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+	switch req.Action {
+	case "stats", "":
+	case "purge":
+		if len(req.Path) > 0 {
+			rel, _, err := resolvePath(req.Path)
+			if err != nil {
+				forbidden(w, r)
+				return
+			}
+			lib.InvalidatePath(rel)
+		} else {
+			lib.PurgeCache()
+		}
+	default:
+		NewResp(w, "unknown action "+req.Action, nil, 1)
+		return
+	}
+	NewResp(w, lib.ListCacheStats(), nil)
+}
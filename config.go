@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/kiyor/k2fs/lib"
+	"gopkg.in/yaml.v3"
+)
+
+// Config of -config yaml file, flag set in command line overwrite it,
+// empty value keep default
+type Config struct {
+	Listen    string           `yaml:"listen"`
+	Interface string           `yaml:"interface"`
+	Root      string           `yaml:"root"`
+	DB        string           `yaml:"db"`
+	Meta      string           `yaml:"meta"`
+	Host      string           `yaml:"host"`
+	Static    string           `yaml:"static"`
+	Df        []string         `yaml:"df"`
+	Redis     string           `yaml:"redis"`
+	Cache     string           `yaml:"cache"` // redis or sqlite
+	Torrents  []*TorrentClient `yaml:"torrents"`
+	Webhooks  []*Webhook       `yaml:"webhooks"`
+
+	// below reload by SIGHUP
+	Proxy     *string           `yaml:"proxy"` // socks5 proxy of search providers, empty is direct
+	Hide      HideConfig        `yaml:"hide"`
+	VideoExt  map[string]string `yaml:"video_ext"` // ext to mime type
+	PhotoExt  []string          `yaml:"photo_ext"`
+	AV        []string          `yaml:"av"` // regexp of av id
+	Providers []ProviderConfig  `yaml:"providers"`
+	DfAlerts  []*DiskAlert      `yaml:"df_alerts"`
+}
+
+type HideConfig struct {
+	Ext     []string `yaml:"ext"`
+	Contain []string `yaml:"contain"`
+	Regexp  []string `yaml:"regexp"`
+}
+
+// ProviderConfig search provider, url is prefix of search keyword,
+// regexp match title and name of result
+type ProviderConfig struct {
+	URL    string `yaml:"url"`
+	Regexp string `yaml:"regexp"`
+}
+
+// rules compiled from config
+type rules struct {
+	hideExt     []string
+	hideContain []string
+	hideRe      []*regexp.Regexp
+	videoExt    map[string]string
+	photoExt    []string
+	reAV        []*regexp.Regexp
+	providers   []*lib.SearchConfig
+	diskAlerts  []*DiskAlert
+}
+
+var (
+	// rulesMu guard hide rule and file type table which can be reloaded
+	rulesMu sync.RWMutex
+	// built in rules, used when key removed from config
+	defaultRules *rules
+)
+
+func currentRules() *rules {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return &rules{
+		hideExt:     hideExt,
+		hideContain: hideContain,
+		hideRe:      hideRe,
+		videoExt:    videoExt,
+		photoExt:    photoExt,
+		reAV:        reAV,
+		providers:   lib.SearchConfigs(),
+		diskAlerts:  diskAlerts,
+	}
+}
+
+func loadConfig(file string) (*Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &c, nil
+}
+
+func compileRe(list []string) ([]*regexp.Regexp, error) {
+	var out []*regexp.Regexp
+	for _, v := range list {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, re)
+	}
+	return out, nil
+}
+
+func normExt(ext string) (string, error) {
+	if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+		return "", fmt.Errorf("invalid ext %q, should be like .mp4", ext)
+	}
+	return strings.ToLower(ext), nil
+}
+
+// rules validate and compile reloadable part of config, nil field is default
+func (c *Config) rules() (*rules, error) {
+	var r rules
+	var err error
+	for _, v := range c.Hide.Ext {
+		ext, err := normExt(v)
+		if err != nil {
+			return nil, fmt.Errorf("hide.ext: %w", err)
+		}
+		r.hideExt = append(r.hideExt, strings.ToUpper(ext))
+	}
+	r.hideContain = c.Hide.Contain
+	if r.hideRe, err = compileRe(c.Hide.Regexp); err != nil {
+		return nil, fmt.Errorf("hide.regexp: %w", err)
+	}
+	if c.VideoExt != nil {
+		r.videoExt = make(map[string]string)
+		for k, v := range c.VideoExt {
+			ext, err := normExt(k)
+			if err != nil {
+				return nil, fmt.Errorf("video_ext: %w", err)
+			}
+			r.videoExt[ext] = v
+		}
+	}
+	for _, v := range c.PhotoExt {
+		ext, err := normExt(v)
+		if err != nil {
+			return nil, fmt.Errorf("photo_ext: %w", err)
+		}
+		r.photoExt = append(r.photoExt, ext)
+	}
+	if r.reAV, err = compileRe(c.AV); err != nil {
+		return nil, fmt.Errorf("av: %w", err)
+	}
+	for _, v := range c.Providers {
+		u, err := url.Parse(v.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("providers: invalid url %q", v.URL)
+		}
+		re, err := regexp.Compile(v.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("providers: %w", err)
+		}
+		if re.NumSubexp() < 2 {
+			return nil, fmt.Errorf("providers: regexp %q need 2 group of title and name", v.Regexp)
+		}
+		r.providers = append(r.providers, &lib.SearchConfig{Prefix: v.URL, Regex: re})
+	}
+	for _, a := range c.DfAlerts {
+		if err := a.validate(); err != nil {
+			return nil, fmt.Errorf("df_alerts: %w", err)
+		}
+		r.diskAlerts = append(r.diskAlerts, a)
+	}
+	if c.Proxy != nil && len(*c.Proxy) > 0 {
+		if _, _, err := net.SplitHostPort(*c.Proxy); err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+	}
+	return &r, nil
+}
+
+func (c *Config) applyRules(r *rules) {
+	d := defaultRules
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	hideExt = or(r.hideExt, d.hideExt)
+	hideContain = or(r.hideContain, d.hideContain)
+	hideRe = or(r.hideRe, d.hideRe)
+	photoExt = or(r.photoExt, d.photoExt)
+	reAV = or(r.reAV, d.reAV)
+	// alert of -df-alert overwrite df_alerts
+	diskAlerts = d.diskAlerts
+	if !setFlags()["df-alert"] {
+		diskAlerts = or(r.diskAlerts, d.diskAlerts)
+	}
+	videoExt = d.videoExt
+	if r.videoExt != nil {
+		videoExt = r.videoExt
+	}
+	proxy := lib.DefaultSearchProxy
+	if c.Proxy != nil {
+		proxy = *c.Proxy
+	}
+	lib.SetSearch(proxy, or(r.providers, d.providers))
+}
+
+func or[T any](a, b []T) []T {
+	if a != nil {
+		return a
+	}
+	return b
+}
+
+// setFlags return name of flag set in command line
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyFlags set value of config if flag not set in command line
+func (c *Config) applyFlags() {
+	set := setFlags()
+	str := map[string]struct {
+		dst *string
+		val string
+	}{
+		"l":      {&port, c.Listen},
+		"i":      {&intf, c.Interface},
+		"root":   {&rootDir, c.Root},
+		"db":     {&dbDir, c.DB},
+		"meta":   {&metaHost, c.Meta},
+		"host":   {&flagHost, c.Host},
+		"static": {&flagStaticFileHost, c.Static},
+		"redis":  {&lib.RedisHost, c.Redis},
+		"cache":  {&flagCache, c.Cache},
+	}
+	for name, v := range str {
+		if !set[name] && len(v.val) > 0 {
+			*v.dst = v.val
+		}
+	}
+	if !set["df"] && len(c.Df) > 0 {
+		flagDf = c.Df
+	}
+	if !set["torrent"] && len(c.Torrents) > 0 {
+		torrentClients = c.Torrents
+	}
+	if !set["webhook"] && len(c.Webhooks) > 0 {
+		webhooks = c.Webhooks
+	}
+}
+
+// validate static part of config after flag applied
+func validateConfig() error {
+	var errs error
+	if f, err := os.Stat(rootDir); err != nil || !f.IsDir() {
+		errs = errors.Join(errs, fmt.Errorf("root %q is not a dir", rootDir))
+	}
+	if f, err := os.Stat(dbDir); err != nil || !f.IsDir() {
+		errs = errors.Join(errs, fmt.Errorf("db %q is not a dir", dbDir))
+	}
+	switch flagCache {
+	case "auto", "sqlite":
+	case "redis":
+		if len(lib.RedisHost) == 0 {
+			errs = errors.Join(errs, errors.New("cache redis need redis host"))
+		}
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown cache backend %q", flagCache))
+	}
+	for _, v := range []string{flagHost, flagStaticFileHost} {
+		if len(v) == 0 {
+			continue
+		}
+		if u, err := url.Parse(v); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			errs = errors.Join(errs, fmt.Errorf("invalid host %q, should be like http://a.com:8080", v))
+		}
+	}
+	for _, v := range flagDf {
+		if _, err := os.Stat(v); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("df: %w", err))
+		}
+	}
+	for _, v := range torrentClients {
+		errs = errors.Join(errs, v.init())
+	}
+	for _, v := range webhooks {
+		errs = errors.Join(errs, v.validate())
+	}
+	return errs
+}
+
+// initConfig load -config file, exit if invalid
+func initConfig() {
+	if len(flagConfig) == 0 {
+		return
+	}
+	defaultRules = currentRules()
+	c, err := loadConfig(flagConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := c.rules()
+	if err != nil {
+		log.Fatal(flagConfig, ": ", err)
+	}
+	c.applyFlags()
+	c.applyRules(r)
+}
+
+// reloadConfig reload hide rule, file type table and providers on SIGHUP
+func reloadConfig() {
+	if len(flagConfig) == 0 {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		c, err := loadConfig(flagConfig)
+		if err == nil {
+			var r *rules
+			r, err = c.rules()
+			if err == nil {
+				c.applyRules(r)
+				lib.PurgeCache()
+			}
+		}
+		if err != nil {
+			log.Println("reload config", err)
+			continue
+		}
+		log.Println("reload config", flagConfig)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/kiyor/k2fs/lib"
+	kfs "github.com/kiyor/k2fs/lib"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/webdav"
+
+// davFS is webdav file system under root of a user, hidden file not listed,
+// delete move to trash and rename keep meta in sync like web ui did
+type davFS struct {
+	webdav.Dir
+	root string // relative to rootDir
+	user *lib.User
+	r    *http.Request // request of audit
+}
+
+func newDavFS(r *http.Request) *davFS {
+	u := requestUser(r)
+	var root string
+	if u != nil {
+		root = strings.Trim(u.Root, "/")
+	}
+	return &davFS{
+		Dir:  webdav.Dir(filepath.Join(rootDir, root)),
+		root: root,
+		user: u,
+		r:    r,
+	}
+}
+
+// rel return path relative to rootDir of webdav name
+func (fs *davFS) rel(name string) string {
+	return strings.Trim(path.Join(fs.root, path.Clean("/"+name)), "/")
+}
+
+// hidden same as web ui, but subtitle still visible for player use webdav,
+// symlink point outside of root and file in trash user can not see also hidden
+func (fs *davFS) hidden(name string) bool {
+	rel := fs.rel(name)
+	if _, _, err := resolvePath(rel); err != nil || isPrivate(rel) {
+		return true
+	}
+	if fs.user != nil && !trashAllowed(fs.user, rel, fs.user.Visible) {
+		return true
+	}
+	return needHide(rel) && !isSubtitle(rel)
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if fs.hidden(name) {
+		return os.ErrPermission
+	}
+	return fs.Dir.Mkdir(ctx, name, perm)
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if fs.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f, fs: fs, name: name}, nil
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if fs.hidden(name) {
+		return nil, os.ErrNotExist
+	}
+	return fs.Dir.Stat(ctx, name)
+}
+
+// RemoveAll move file to trash, only file already in trash really deleted
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	if fs.hidden(name) {
+		return os.ErrNotExist
+	}
+	rel := fs.rel(name)
+	if len(rel) == 0 || rel == ".Trash" {
+		return os.ErrPermission
+	}
+	file := filepath.Join(rootDir, rel)
+	if _, err := os.Lstat(file); err != nil {
+		return err
+	}
+	opMutex.Lock()
+	defer opMutex.Unlock()
+	defer lib.InvalidatePath(rel, ".Trash")
+	if strings.HasPrefix(file, Trash+"/") {
+		err := os.RemoveAll(file)
+		log.Println("rm -rf", file, err)
+		e := newAudit(fs.r, "webdav", "purge", rel)
+		audit(e, err)
+		if err == nil {
+			auditEvent("file.purged", e)
+		}
+		metaV2.RemoveOrphan(".Trash")
+		return err
+	}
+	dir, k := filepath.Split(file)
+	dst := filepath.Join(Trash, k)
+	log.Println("mv", file, dst)
+	e := newAudit(fs.r, "webdav", "delete", rel)
+	e.Dst = filepath.Join(".Trash", k)
+	err := os.Rename(file, dst)
+	audit(e, err)
+	if err != nil {
+		return err
+	}
+	auditEvent("file.trashed", e)
+	meta := kfs.NewMeta(dir)
+	m, _ := meta.Get(k)
+	meta.Del(k)
+	meta.Write()
+	m.OldLoc = file
+	trashMeta := kfs.NewMeta(Trash)
+	trashMeta.Set(k, m)
+	err = trashMeta.Write()
+	if err != nil {
+		log.Println(err)
+	}
+	metaV2.MovePath(rel, filepath.Join(".Trash", k))
+	return nil
+}
+
+// Rename move file and its meta
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if fs.hidden(oldName) || fs.hidden(newName) {
+		return os.ErrPermission
+	}
+	opMutex.Lock()
+	defer opMutex.Unlock()
+	src, dst := fs.rel(oldName), fs.rel(newName)
+	e := newAudit(fs.r, "webdav", "move", src)
+	e.Dst = dst
+	err := fs.Dir.Rename(ctx, oldName, newName)
+	audit(e, err)
+	if err != nil {
+		return err
+	}
+	auditEvent("file.moved", e)
+	defer lib.InvalidatePath(src, dst)
+	log.Println("mv", src, dst)
+	srcMeta := kfs.NewMeta(filepath.Join(rootDir, filepath.Dir(src)))
+	if m, ok := srcMeta.Get(filepath.Base(src)); ok {
+		srcMeta.Del(filepath.Base(src))
+		srcMeta.Write()
+		dstMeta := kfs.NewMeta(filepath.Join(rootDir, filepath.Dir(dst)))
+		dstMeta.Set(filepath.Base(dst), m)
+		dstMeta.Write()
+	}
+	return metaV2.MovePath(src, dst)
+}
+
+type davFile struct {
+	webdav.File
+	fs   *davFS
+	name string
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+	var out []os.FileInfo
+	for _, fi := range fis {
+		if !f.fs.hidden(path.Join(f.name, fi.Name())) {
+			out = append(out, fi)
+		}
+	}
+	return out, err
+}
+
+var (
+	davLocks   = make(map[string]webdav.LockSystem)
+	davLocksMu sync.Mutex
+)
+
+// davLock return lock system of webdav root, names of lock is relative to it
+func davLock(root string) webdav.LockSystem {
+	davLocksMu.Lock()
+	defer davLocksMu.Unlock()
+	ls, ok := davLocks[root]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks[root] = ls
+	}
+	return ls
+}
+
+func serveDav(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.Header().Add("DAV", "1,2")
+		w.Header().Add("Allow", "OPTIONS, GET, HEAD, POST, DELETE, PROPFIND, PROPPATCH, COPY, MOVE, LOCK, UNLOCK")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fs := newDavFS(r)
+	if !davAllowed(r, fs) {
+		forbidden(w, r)
+		return
+	}
+	h := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fs,
+		LockSystem: davLock(fs.root),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Println("webdav", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	if davPerm(r.Method) == lib.PermRead || r.Method == "LOCK" || r.Method == "UNLOCK" {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if r.Method == "PUT" {
+		release, ok := rateLimit(w, r, "upload")
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	// delete and move are audited by file system with path in trash
+	if r.Method == "DELETE" || r.Method == "MOVE" {
+		h.ServeHTTP(w, r)
+		return
+	}
+	e := newAudit(r, "webdav", strings.ToLower(r.Method), fs.rel(strings.TrimPrefix(r.URL.Path, davPrefix)))
+	if dst := r.Header.Get("Destination"); len(dst) > 0 {
+		if u, err := url.Parse(dst); err == nil {
+			e.Dst = fs.rel(strings.TrimPrefix(u.Path, davPrefix))
+		}
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	h.ServeHTTP(sw, r)
+	lib.InvalidatePath(e.Path)
+	if len(e.Dst) > 0 {
+		lib.InvalidatePath(e.Dst)
+	}
+	var err error
+	if sw.status >= 400 {
+		err = errors.New(http.StatusText(sw.status))
+	}
+	audit(e, err)
+}
+
+// nonce of digest auth is timestamp and random signed by random key, invalid after restart
+var digestKey = securecookie.GenerateRandomKey(32)
+
+const digestNonceTTL = 5 * time.Minute
+
+func digestSign(ts string) string {
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write([]byte(ts))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// digestNonce is unique by random part, nc is counted per nonce
+func digestNonce() string {
+	ts := strconv.FormatInt(time.Now().Unix(), 16) + "." + hex.EncodeToString(securecookie.GenerateRandomKey(8))
+	return ts + "-" + digestSign(ts)
+}
+
+func digestNonceValid(nonce string) bool {
+	p := strings.SplitN(nonce, "-", 2)
+	if len(p) != 2 || !hmac.Equal([]byte(p[1]), []byte(digestSign(p[0]))) {
+		return false
+	}
+	ts, err := strconv.ParseInt(strings.Split(p[0], ".")[0], 16, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(ts, 0)) < digestNonceTTL
+}
+
+// errDigestStale is nonce expired or replayed, client retry with new nonce
+var errDigestStale = errors.New("stale digest nonce")
+
+func digestChallenge(stale bool) string {
+	c := `Digest realm="` + lib.DigestRealm + `", qop="auth", algorithm=MD5, nonce="` + digestNonce() + `"`
+	if stale {
+		c += ", stale=true"
+	}
+	return c
+}
+
+var reDigestParam = regexp.MustCompile(`(\w+)=("[^"]*"|[^,\s]*)`)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestUser verify http digest auth of request, rfc 2617 with qop auth,
+// nc of nonce must increase
+func digestUser(r *http.Request) (*lib.User, error) {
+	p := make(map[string]string)
+	for _, m := range reDigestParam.FindAllStringSubmatch(strings.TrimPrefix(r.Header.Get("Authorization"), "Digest "), -1) {
+		p[m[1]] = strings.Trim(m[2], `"`)
+	}
+	if p["realm"] != lib.DigestRealm || p["uri"] != r.URL.RequestURI() {
+		return nil, errors.New("invalid digest")
+	}
+	if !digestNonceValid(p["nonce"]) {
+		return nil, errDigestStale
+	}
+	u, err := metaV2.GetUser(p["username"])
+	if err != nil {
+		return nil, err
+	}
+	if len(u.DigestHA1) == 0 {
+		return nil, errors.New("digest not available, reset password of " + u.Name)
+	}
+	// qop auth is required, nc of it prevent replay
+	if p["qop"] != "auth" {
+		return nil, errors.New("invalid digest")
+	}
+	ha2 := md5Hex(r.Method + ":" + p["uri"])
+	expect := md5Hex(u.DigestHA1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+	if subtle.ConstantTimeCompare([]byte(expect), []byte(p["response"])) != 1 {
+		return nil, errors.New("invalid digest")
+	}
+	if !digestCountValid(p["nonce"], p["nc"]) {
+		return nil, errDigestStale
+	}
+	return u, nil
+}
+
+var (
+	// digestCounts is highest nc used of nonce, request with nc not greater
+	// than it is a replay
+	digestCounts   = make(map[string]uint64)
+	digestCountsMu sync.Mutex
+)
+
+func digestCountValid(nonce, nc string) bool {
+	n, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil {
+		return false
+	}
+	digestCountsMu.Lock()
+	defer digestCountsMu.Unlock()
+	last, ok := digestCounts[nonce]
+	if ok && n <= last {
+		return false
+	}
+	if !ok {
+		for k := range digestCounts {
+			if !digestNonceValid(k) {
+				delete(digestCounts, k)
+			}
+		}
+	}
+	digestCounts[nonce] = n
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+var dedupeRunning atomic.Bool
+
+// scanDupes hash candidate of duplicate, skip if already running
+func scanDupes() {
+	if !dedupeRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer dedupeRunning.Store(false)
+	t1 := time.Now()
+	s := &lib.DupeScan{MinSize: flagDedupeMin}
+	err := s.Run(metaV2)
+	log.Println("dedupe scan done", s.Hashed, "file hashed", time.Since(t1), err)
+}
+
+// DupesRequest dupes api request
+type DupesRequest struct {
+	Action string `json:"action"` // empty is report, scan start background scan
+	Path   string `json:"path"`   // group with file under path
+}
+
+func apiDupes(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req DupesRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	rel, _, err := resolvePath(req.Path)
+	if err != nil || !allowed(r, rel, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	switch req.Action {
+	case "":
+		list, err := metaV2.ListDupes(rel)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		out := make([]*lib.DupeGroup, 0, len(list))
+		for _, g := range list {
+			var paths []string
+			for _, p := range g.Paths {
+				if visible(r, p) && !isPrivate(p) {
+					paths = append(paths, p)
+				}
+			}
+			if len(paths) > 1 {
+				g.Paths = paths
+				out = append(out, g)
+			}
+		}
+		NewResp(w, out, nil)
+	case "scan":
+		if u := requestUser(r); u != nil && !u.IsAdmin() {
+			forbidden(w, r)
+			return
+		}
+		if dedupeRunning.Load() {
+			NewResp(w, "scan already running", nil)
+			return
+		}
+		if !asyncOps.Go(scanDupes) {
+			NewResp(w, "shutting down", nil, 1)
+			return
+		}
+		NewResp(w, "scan started", nil)
+	default:
+		NewResp(w, "unknown action "+req.Action, nil, 1)
+	}
+}
+
+// hashCurrent report if size and mod time of file still match its hash row,
+// file changed after hashing may not be same content any more
+func hashCurrent(path string) bool {
+	i, err := metaV2.Get(path)
+	if err != nil || !i.HashValid() {
+		return false
+	}
+	f, err := os.Stat(filepath.Join(rootDir, path))
+	return err == nil && f.Size() == i.Size && f.ModTime().Equal(i.HashModTime)
+}
+
+// dupeToKeep return duplicate of path to keep, which is unchanged since
+// hashing and not in selected files of operation, empty if path itself
+// changed
+func dupeToKeep(path string, op *Operation) string {
+	if !hashCurrent(path) {
+		return ""
+	}
+	others, err := metaV2.DupesOf(path)
+	if err != nil {
+		return ""
+	}
+	for _, p := range others {
+		if filepath.Dir(p) == filepath.Join(".", op.Dir) && op.Files[filepath.Base(p)] {
+			continue
+		}
+		if hashCurrent(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// hardlink replace dst by hard link of src
+func hardlink(src, dst string) error {
+	tmp := dst + ".kfs_link"
+	if err := os.Link(src, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
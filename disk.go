@@ -1,8 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/dustin/go-humanize"
+	"github.com/kiyor/k2fs/lib"
 	"github.com/shirou/gopsutil/disk"
 )
 
@@ -32,3 +45,220 @@ func DiskSize(opt []string) []*disk.UsageStat {
 	}
 	return output
 }
+
+// DiskAlert fire once when used or inode percent of mount cross threshold,
+// fire again after it drop below
+type DiskAlert struct {
+	Path    string   `yaml:"path"`    // mount, empty is all monitored
+	Used    float64  `yaml:"used"`    // used percent, 0 not check
+	Inodes  float64  `yaml:"inodes"`  // inode used percent, 0 not check
+	Actions []string `yaml:"actions"` // log, event or purge_trash
+}
+
+var (
+	// guarded by rulesMu, reloadable
+	diskAlerts []*DiskAlert
+	// alert and mount already fired
+	diskAlertFired = make(map[*DiskAlert]map[string]bool)
+)
+
+// parseDiskAlert parse flag like used=90,inodes=95,actions=log+event+purge_trash
+func parseDiskAlert(s string) (*DiskAlert, error) {
+	a := new(DiskAlert)
+	for _, v := range strings.Split(s, ",") {
+		k, val, _ := strings.Cut(v, "=")
+		var err error
+		switch k {
+		case "path":
+			a.Path = val
+		case "used":
+			a.Used, err = strconv.ParseFloat(val, 64)
+		case "inodes":
+			a.Inodes, err = strconv.ParseFloat(val, 64)
+		case "actions":
+			a.Actions = strings.Split(val, "+")
+		default:
+			err = fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("df alert: %w", err)
+		}
+	}
+	return a, a.validate()
+}
+
+func (a *DiskAlert) validate() error {
+	if a.Used <= 0 && a.Inodes <= 0 {
+		return errors.New("df alert need used or inodes threshold")
+	}
+	if len(a.Actions) == 0 {
+		a.Actions = []string{"log"}
+	}
+	for _, v := range a.Actions {
+		switch v {
+		case "log", "event", "purge_trash":
+		default:
+			return fmt.Errorf("df alert: unknown action %q", v)
+		}
+	}
+	return nil
+}
+
+func (a *DiskAlert) over(u *disk.UsageStat) bool {
+	return (a.Used > 0 && u.UsedPercent >= a.Used) || (a.Inodes > 0 && u.InodesUsedPercent >= a.Inodes)
+}
+
+// sampleDisk save usage of monitored mount and check alert
+func sampleDisk() {
+	usage := DiskSize([]string(flagDf))
+	now := time.Now()
+	var list []*lib.DiskSample
+	for _, u := range usage {
+		list = append(list, &lib.DiskSample{
+			Time:              now,
+			Path:              u.Path,
+			Total:             u.Total,
+			Used:              u.Used,
+			Free:              u.Free,
+			UsedPercent:       u.UsedPercent,
+			InodesTotal:       u.InodesTotal,
+			InodesUsed:        u.InodesUsed,
+			InodesUsedPercent: u.InodesUsedPercent,
+		})
+	}
+	if err := metaV2.SaveDiskSamples(list); err != nil {
+		log.Println("df sample", err)
+	}
+	if err := metaV2.PruneDiskSamples(now.Add(-flagDfKeep)); err != nil {
+		log.Println("df sample", err)
+	}
+	rulesMu.RLock()
+	alerts := diskAlerts
+	rulesMu.RUnlock()
+	// forget alert removed by reload
+	for a := range diskAlertFired {
+		if !slices.Contains(alerts, a) {
+			delete(diskAlertFired, a)
+		}
+	}
+	for _, a := range alerts {
+		fired := diskAlertFired[a]
+		if fired == nil {
+			fired = make(map[string]bool)
+			diskAlertFired[a] = fired
+		}
+		for _, u := range usage {
+			if len(a.Path) > 0 && a.Path != u.Path {
+				continue
+			}
+			over := a.over(u)
+			if over && !fired[u.Path] {
+				a.fire(u)
+			}
+			fired[u.Path] = over
+		}
+	}
+}
+
+// DiskAlertEvent is data of disk.alert event
+type DiskAlertEvent struct {
+	Mount             string  `json:"mount"`
+	UsedPercent       float64 `json:"used_percent"`
+	InodesUsedPercent float64 `json:"inodes_used_percent"`
+	Free              uint64  `json:"free"`
+	Used              float64 `json:"threshold_used,omitempty"`
+	Inodes            float64 `json:"threshold_inodes,omitempty"`
+}
+
+func (a *DiskAlert) fire(u *disk.UsageStat) {
+	for _, action := range a.Actions {
+		switch action {
+		case "log":
+			log.Printf("df alert %s used %.2f%% inodes %.2f%% free %s", u.Path, u.UsedPercent, u.InodesUsedPercent, humanize.IBytes(u.Free))
+		case "event":
+			// delivered to webhook of disk.alert and every event stream
+			publish(&Event{Type: "disk.alert", Data: &DiskAlertEvent{
+				Mount:             u.Path,
+				UsedPercent:       u.UsedPercent,
+				InodesUsedPercent: u.InodesUsedPercent,
+				Free:              u.Free,
+				Used:              a.Used,
+				Inodes:            a.Inodes,
+			}})
+		case "purge_trash":
+			if !sameDevice(Trash, u.Path) {
+				log.Println("df alert", u.Path, "trash not on it, skip purge")
+				continue
+			}
+			log.Println("df alert", u.Path, "purge trash")
+			opMutex.Lock()
+			purgeTrash(func(path string) *lib.AuditEntry {
+				return &lib.AuditEntry{Time: time.Now(), Via: "df_alert", Action: "purge", Path: path}
+			})
+			opMutex.Unlock()
+			lib.InvalidatePath(".Trash")
+			metaV2.RemoveOrphan(".Trash")
+		}
+	}
+}
+
+// sameDevice report if two path on same file system
+func sameDevice(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	sa, ok := fa.Sys().(*syscall.Stat_t)
+	sb, ok2 := fb.Sys().(*syscall.Stat_t)
+	return ok && ok2 && sa.Dev == sb.Dev
+}
+
+// DfHistoryRequest df history api request, time in RFC3339, step like 1h
+type DfHistoryRequest struct {
+	Path string `json:"path"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Step string `json:"step"`
+}
+
+func apiDfHistory(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req DfHistoryRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	q := lib.DiskQuery{
+		Path: req.Path,
+		From: time.Now().Add(-24 * time.Hour),
+	}
+	if len(req.From) > 0 {
+		if q.From, err = time.Parse(time.RFC3339, req.From); err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+	}
+	if len(req.To) > 0 {
+		if q.To, err = time.Parse(time.RFC3339, req.To); err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+	}
+	if len(req.Step) > 0 {
+		if q.Step, err = time.ParseDuration(req.Step); err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+	}
+	list, err := metaV2.ListDiskSamples(q)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	NewResp(w, list, nil)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// DuRequest du api request
+type DuRequest struct {
+	Action   string `json:"action"` // empty is report, snapshot or snapshots
+	Path     string `json:"path"`
+	Top      int    `json:"top"`      // number of largest dir and file, default 20
+	Snapshot uint   `json:"snapshot"` // id of snapshot to compare, default latest
+}
+
+// keep daily snapshot of root for growth
+const (
+	duSnapshotEvery = 24 * time.Hour
+	duSnapshotKeep  = 90 * 24 * time.Hour
+)
+
+func apiDu(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req DuRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	rel, _, err := resolvePath(req.Path)
+	// totals only count file readable, parent of grant is fine
+	if err != nil || !visible(r, rel) {
+		forbidden(w, r)
+		return
+	}
+	release, ok := rateLimit(w, r, "du")
+	if !ok {
+		return
+	}
+	defer release()
+	switch req.Action {
+	case "":
+		if req.Top <= 0 || req.Top > 1000 {
+			req.Top = 20
+		}
+		rep, err := metaV2.Du(rel, req.Top, req.Snapshot, func(p string) bool {
+			return visible(r, p) && !isPrivate(p)
+		}, func(p string) bool {
+			return readableTree(r, p)
+		})
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, rep, nil)
+	case "snapshot":
+		// write db, read perm is not enough
+		if !allowed(r, rel, lib.PermWrite) {
+			forbidden(w, r)
+			return
+		}
+		snap, err := metaV2.SnapshotDu(rel)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, snap, nil)
+	case "snapshots":
+		list, err := metaV2.ListDuSnapshots(rel)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, list, nil)
+	default:
+		NewResp(w, "unknown action "+req.Action, nil, 1)
+	}
+}
+
+// snapshotDu snapshot root if last one older than a day
+func snapshotDu() {
+	if snap, err := metaV2.GetDuSnapshot("", 0); err == nil && time.Since(snap.CreatedAt) < duSnapshotEvery {
+		return
+	}
+	if _, err := metaV2.SnapshotDu(""); err != nil {
+		log.Println("du snapshot", err)
+	}
+	if err := metaV2.PruneDuSnapshots(time.Now().Add(-duSnapshotKeep)); err != nil {
+		log.Println("du snapshot", err)
+	}
+}
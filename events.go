@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+	"gorm.io/datatypes"
+)
+
+// Event is change of file published to webhook and event stream
+type Event struct {
+	ID    uint64      `json:"id"`
+	Type  string      `json:"type"` // like file.trashed, label.changed, download.done
+	Path  string      `json:"path"` // relative to root
+	Dst   string      `json:"dst,omitempty"`
+	IsDir bool        `json:"is_dir,omitempty"`
+	User  string      `json:"user,omitempty"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Webhook receive event match its type, X-K2fs-Signature is hmac sha256 by
+// secret of X-K2fs-Timestamp, a dot and body, so old delivery can be rejected
+type Webhook struct {
+	URL     string   `yaml:"url"`
+	Secret  string   `yaml:"secret"`  // empty not signed
+	Events  []string `yaml:"events"`  // event type or prefix end with dot like file., empty is all
+	Retries int      `yaml:"retries"` // retry before dead letter, default 5
+}
+
+var (
+	webhooks []*Webhook
+	// id keep increasing across restart
+	eventID = func() *atomic.Uint64 {
+		var id atomic.Uint64
+		id.Store(uint64(time.Now().UnixMilli()) * 1000)
+		return &id
+	}()
+	subsMu sync.Mutex
+	subs   = make(map[chan *Event]struct{})
+	// index event dropped until first full index done
+	indexReady atomic.Bool
+)
+
+// parseWebhook parse flag like url=http://a.com/hook,secret=xxx,events=file.+download.done,retries=5
+func parseWebhook(s string) (*Webhook, error) {
+	h := new(Webhook)
+	for _, v := range strings.Split(s, ",") {
+		k, val, _ := strings.Cut(v, "=")
+		var err error
+		switch k {
+		case "url":
+			h.URL = val
+		case "secret":
+			h.Secret = val
+		case "events":
+			h.Events = strings.Split(val, "+")
+		case "retries":
+			h.Retries, err = strconv.Atoi(val)
+		default:
+			err = fmt.Errorf("unknown option %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %w", err)
+		}
+	}
+	return h, nil
+}
+
+func (h *Webhook) validate() error {
+	if u, err := url.Parse(h.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("webhook: invalid url %q", h.URL)
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("webhook: invalid retries %d", h.Retries)
+	}
+	if h.Retries == 0 {
+		h.Retries = 5
+	}
+	return nil
+}
+
+func (h *Webhook) match(typ string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, v := range h.Events {
+		if v == typ || (strings.HasSuffix(v, ".") && strings.HasPrefix(typ, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish send event to stream subscriber and matched webhook
+func publish(e *Event) {
+	e.ID = eventID.Add(1)
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	subsMu.Lock()
+	for ch := range subs {
+		select {
+		case ch <- e:
+		default:
+			// slow client miss event, it reload on reconnect
+		}
+	}
+	subsMu.Unlock()
+	for _, h := range webhooks {
+		if h.match(e.Type) {
+			h := h
+			if !deliveries.Go(func() { deliver(h, e) }) {
+				log.Println("webhook", h.URL, e.Type, e.Path, "dropped, shutting down")
+			}
+		}
+	}
+}
+
+// emit publish event of request user
+func emit(r *http.Request, typ, path string, data interface{}) {
+	publish(&Event{Type: typ, Path: path, User: currentUser(r), Data: data})
+}
+
+// auditEvent publish event of audited action
+func auditEvent(typ string, e *lib.AuditEntry) {
+	publish(&Event{Type: typ, Path: e.Path, Dst: e.Dst, User: e.User})
+}
+
+// indexEvent publish change found by index, trash is left out
+func indexEvent(action string, i *lib.MetaInfoV2) {
+	if !indexReady.Load() || i.Path == ".Trash" || strings.HasPrefix(i.Path, ".Trash/") {
+		return
+	}
+	publish(&Event{Type: "file." + action, Path: i.Path, IsDir: i.IsDir()})
+}
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postEvent(h *Webhook, e *Event, body []byte) error {
+	req, err := http.NewRequestWithContext(deliverCtx, "POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-K2fs-Event", e.Type)
+	req.Header.Set("X-K2fs-Delivery", strconv.FormatUint(e.ID, 10))
+	// time of this attempt, not of event
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-K2fs-Timestamp", ts)
+	if len(h.Secret) > 0 {
+		req.Header.Set("X-K2fs-Signature", sign(h.Secret, ts, body))
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s status code %d", h.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+// deliver post event to webhook, retry with backoff, save dead letter if
+// all failed or failed once shutting down
+func deliver(h *Webhook, e *Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Println("webhook", err)
+		return
+	}
+	backoff := time.Second
+	var attempts int
+	for {
+		attempts++
+		if err = postEvent(h, e, body); err == nil {
+			return
+		}
+		if attempts > h.Retries || appCtx.Err() != nil {
+			break
+		}
+		select {
+		case <-appCtx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 5*time.Minute {
+			backoff = 5 * time.Minute
+		}
+	}
+	log.Println("webhook", h.URL, e.Type, e.Path, "failed", attempts, err)
+	d := &lib.DeadLetter{
+		Webhook:   h.URL,
+		EventType: e.Type,
+		Event:     datatypes.JSON(body),
+		Attempts:  attempts,
+		Error:     err.Error(),
+	}
+	if err := metaV2.SaveDeadLetter(d); err != nil {
+		log.Println("webhook", err)
+	}
+}
+
+func subscribe() (chan *Event, func()) {
+	ch := make(chan *Event, 64)
+	subsMu.Lock()
+	subs[ch] = struct{}{}
+	subsMu.Unlock()
+	return ch, func() {
+		subsMu.Lock()
+		delete(subs, ch)
+		subsMu.Unlock()
+	}
+}
+
+// serveEvents stream event of path user can read as server sent events,
+// path query limit to event under path
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	rel, _, err := resolvePath(r.URL.Query().Get("path"))
+	if err != nil || !allowed(r, rel, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "stream not supported", http.StatusInternalServerError)
+		return
+	}
+	prefix := strings.Trim(rel, "/")
+	if prefix == "." {
+		prefix = ""
+	}
+	under := func(p string) bool {
+		return len(p) > 0 && (len(prefix) == 0 || p == prefix || strings.HasPrefix(p, prefix+"/"))
+	}
+	readable := func(p string) bool {
+		return len(p) == 0 || (allowed(r, p, lib.PermRead) && !isPrivate(p))
+	}
+	ch, cancel := subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// gzip handler buffer small write, identity make it pass through
+	w.Header().Set("Content-Encoding", "identity")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-appCtx.Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case e := <-ch:
+			// event without path like disk.alert is for everyone
+			if len(e.Path) > 0 && !under(e.Path) && !under(e.Dst) {
+				continue
+			}
+			// name of both side is in event
+			if !readable(e.Path) || !readable(e.Dst) {
+				continue
+			}
+			b, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b)
+		}
+		flusher.Flush()
+	}
+}
+
+// EventsRequest events api request
+type EventsRequest struct {
+	Action string `json:"action"` // empty list dead letter, retry or delete
+	ID     uint   `json:"id"`
+	Limit  int    `json:"limit"`
+}
+
+func apiEvents(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if u := requestUser(r); u != nil && !u.IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+	var req EventsRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	switch req.Action {
+	case "":
+		if req.Limit <= 0 || req.Limit > 1000 {
+			req.Limit = 100
+		}
+		list, err := metaV2.ListDeadLetters(req.Limit)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, list, nil)
+	case "retry":
+		d, err := metaV2.GetDeadLetter(req.ID)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		var e Event
+		if err := json.Unmarshal(d.Event, &e); err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		h := &Webhook{URL: d.Webhook}
+		for _, v := range webhooks {
+			if v.URL == d.Webhook {
+				h = v
+			}
+		}
+		if err := postEvent(h, &e, d.Event); err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		metaV2.DelDeadLetter(d.ID)
+		NewResp(w, "success", nil)
+	case "delete":
+		if err := metaV2.DelDeadLetter(req.ID); err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, "success", nil)
+	default:
+		NewResp(w, "unknown action "+req.Action, nil, 1)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+var (
+	// codec browser can play, stream will be copied instead of transcoded
+	hlsVideoCodec = []string{"h264"}
+	hlsAudioCodec = []string{"aac", "mp3"}
+)
+
+// hlsLink return hls entry link of video, empty if ffmpeg not available
+func hlsLink(path string) string {
+	if !hls.Enabled() {
+		return ""
+	}
+	return "/hls?" + url.Values{"path": {"/" + strings.TrimLeft(path, "/")}}.Encode()
+}
+
+type HlsSession struct {
+	ID        string
+	Path      string
+	Dir       string
+	Transcode bool
+	Start     time.Time
+
+	cmd        *exec.Cmd
+	lastAccess time.Time
+	started    chan struct{} // closed after ffmpeg started or failed
+	done       chan struct{}
+	err        error
+}
+
+func (s *HlsSession) playlist() string {
+	return filepath.Join(s.Dir, "index.m3u8")
+}
+
+// ready wait until the playlist has first segment
+func (s *HlsSession) ready(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if b, err := os.ReadFile(s.playlist()); err == nil && strings.Contains(string(b), "#EXTINF") {
+			return nil
+		}
+		select {
+		case <-s.done:
+			if s.err != nil {
+				return s.err
+			}
+			if _, err := os.Stat(s.playlist()); err == nil {
+				return nil
+			}
+			return errors.New("ffmpeg exit without output")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	return errors.New("hls session start timeout")
+}
+
+func (s *HlsSession) stop() {
+	<-s.started
+	if s.cmd != nil && s.cmd.Process != nil {
+		select {
+		case <-s.done:
+		default:
+			s.cmd.Process.Kill()
+			<-s.done
+		}
+	}
+	os.RemoveAll(s.Dir)
+}
+
+type HlsManager struct {
+	Dir     string
+	Max     int
+	Idle    time.Duration
+	FFmpeg  string
+	FFprobe string
+
+	sessions map[string]*HlsSession
+	mu       *sync.Mutex
+}
+
+// NewHlsManager keep segment in k2fs-hls under dir, only that is removed
+func NewHlsManager(dir string, max int, idle time.Duration) *HlsManager {
+	m := &HlsManager{
+		Dir:      filepath.Join(dir, "k2fs-hls"),
+		Max:      max,
+		Idle:     idle,
+		sessions: make(map[string]*HlsSession),
+		mu:       new(sync.Mutex),
+	}
+	if p, err := exec.LookPath("ffmpeg"); err == nil {
+		m.FFmpeg = p
+	}
+	if p, err := exec.LookPath("ffprobe"); err == nil {
+		m.FFprobe = p
+	}
+	return m
+}
+
+func (m *HlsManager) Enabled() bool {
+	return m != nil && len(m.FFmpeg) > 0
+}
+
+// Get return running session of path or start a new one, slot is
+// reserved under lock and ffprobe run outside it
+func (m *HlsManager) Get(path string) (*HlsSession, error) {
+	path = strings.TrimLeft(path, "/")
+	id := hash(path)
+	m.mu.Lock()
+	if s, ok := m.sessions[id]; ok {
+		s.lastAccess = time.Now()
+		m.mu.Unlock()
+		return s, nil
+	}
+	if len(m.sessions) >= m.Max {
+		// reuse slot of the most idle session
+		var oldest *HlsSession
+		for _, s := range m.sessions {
+			if oldest == nil || s.lastAccess.Before(oldest.lastAccess) {
+				oldest = s
+			}
+		}
+		if oldest == nil || time.Since(oldest.lastAccess) < 30*time.Second {
+			m.mu.Unlock()
+			return nil, fmt.Errorf("too many hls sessions (%d)", m.Max)
+		}
+		log.Println("hls evict", oldest.Path)
+		delete(m.sessions, oldest.ID)
+		go oldest.stop()
+	}
+	s := &HlsSession{
+		ID:         id,
+		Path:       path,
+		Dir:        filepath.Join(m.Dir, id),
+		Start:      time.Now(),
+		lastAccess: time.Now(),
+		started:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	m.sessions[id] = s
+	m.mu.Unlock()
+	err := m.start(s)
+	if err != nil {
+		// request waiting in ready get the error
+		s.err = err
+		close(s.done)
+		m.mu.Lock()
+		if m.sessions[id] == s {
+			delete(m.sessions, id)
+		}
+		m.mu.Unlock()
+	}
+	close(s.started)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *HlsManager) touch(id string) (*HlsSession, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if ok {
+		s.lastAccess = time.Now()
+	}
+	return s, ok
+}
+
+func (m *HlsManager) start(s *HlsSession) error {
+	abs := filepath.Join(rootDir, s.Path)
+	if _, err := os.Stat(abs); err != nil {
+		return err
+	}
+	os.RemoveAll(s.Dir)
+	err := os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	vcodec, acodec := m.probe(abs)
+	args := []string{"-hide_banner", "-loglevel", "error", "-i", abs, "-map", "0:v:0", "-map", "0:a:0?", "-sn"}
+	if contains(hlsVideoCodec, vcodec) {
+		args = append(args, "-c:v", "copy")
+	} else {
+		s.Transcode = true
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p")
+	}
+	if len(acodec) == 0 || contains(hlsAudioCodec, acodec) {
+		args = append(args, "-c:a", "copy")
+	} else {
+		s.Transcode = true
+		args = append(args, "-c:a", "aac", "-ac", "2", "-b:a", "192k")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "6",
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_base_url", "/hls/"+s.ID+"/",
+		"-hls_segment_filename", filepath.Join(s.Dir, "seg_%05d.ts"),
+		s.playlist(),
+	)
+	s.cmd = exec.Command(m.FFmpeg, args...)
+	s.cmd.Stderr = os.Stderr
+	log.Println("hls start", s.Path, "video:", vcodec, "audio:", acodec, "transcode:", s.Transcode)
+	err = s.cmd.Start()
+	if err != nil {
+		return err
+	}
+	go func() {
+		s.err = s.cmd.Wait()
+		close(s.done)
+		log.Println("hls done", s.Path, time.Since(s.Start), s.err)
+	}()
+	return nil
+}
+
+// probe return codec name of first video and audio stream
+func (m *HlsManager) probe(abs string) (vcodec, acodec string) {
+	if len(m.FFprobe) == 0 {
+		return
+	}
+	codec := func(stream string) string {
+		out, err := exec.Command(m.FFprobe, "-v", "error", "-select_streams", stream, "-show_entries", "stream=codec_name", "-of", "csv=p=0", abs).Output()
+		if err != nil {
+			log.Println("ffprobe", abs, err)
+			return ""
+		}
+		return strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	}
+	return codec("v:0"), codec("a:0")
+}
+
+// Cleanup stop and remove session idle longer than m.Idle
+func (m *HlsManager) Cleanup() {
+	m.mu.Lock()
+	var idle []*HlsSession
+	for id, s := range m.sessions {
+		if time.Since(s.lastAccess) > m.Idle {
+			idle = append(idle, s)
+			delete(m.sessions, id)
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range idle {
+		log.Println("hls cleanup", s.Path)
+		s.stop()
+	}
+}
+
+// StopAll stop all ffmpeg and remove segment
+func (m *HlsManager) StopAll() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	var all []*HlsSession
+	for id, s := range m.sessions {
+		all = append(all, s)
+		delete(m.sessions, id)
+	}
+	m.mu.Unlock()
+	for _, s := range all {
+		s.stop()
+	}
+	if m.Enabled() {
+		m.Clear()
+	}
+}
+
+// Clear remove segment left by last run
+func (m *HlsManager) Clear() {
+	os.RemoveAll(m.Dir)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var hls *HlsManager
+
+// serveHls
+// /hls?path=/a/b.mkv -> start session and redirect to /hls/<id>/index.m3u8
+// /hls/<id>/<file>   -> playlist and segment of session
+func serveHls(w http.ResponseWriter, r *http.Request) {
+	if !hls.Enabled() {
+		http.Error(w, "ffmpeg not found", http.StatusNotImplemented)
+		return
+	}
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/hls"), "/")
+	if len(p) == 0 {
+		path, _, err := resolvePath(r.URL.Query().Get("path"))
+		if err != nil {
+			forbidden(w, r)
+			return
+		}
+		if !isVideo(path) {
+			http.Error(w, "not a video", http.StatusBadRequest)
+			return
+		}
+		if !allowed(r, path, lib.PermRead) {
+			forbidden(w, r)
+			return
+		}
+		s, err := hls.Get(path)
+		if err != nil {
+			log.Println(err)
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		err = s.ready(30 * time.Second)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/hls/"+s.ID+"/index.m3u8", http.StatusFound)
+		return
+	}
+	id, file, ok := strings.Cut(p, "/")
+	if !ok || strings.Contains(file, "/") || strings.HasPrefix(file, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	s, ok := hls.touch(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowed(r, s.Path, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	switch filepath.Ext(file) {
+	case ".m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	case ".ts":
+		w.Header().Set("Content-Type", "video/MP2T")
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeFile(w, r, filepath.Join(s.Dir, file))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// initKV select cache backend, exit if failed
+func initKV() {
+	backend := flagCache
+	if backend == "auto" {
+		backend = "sqlite"
+		if len(lib.RedisHost) > 0 {
+			backend = "redis"
+		}
+	}
+	if err := lib.InitKV(backend, metaV2); err != nil {
+		log.Fatal(err)
+	}
+	s, ok := lib.KV.KVBackend.(*lib.SqliteKV)
+	if !ok {
+		return
+	}
+	if flagCacheMigrate && len(lib.RedisHost) > 0 {
+		for _, pattern := range []string{"AV:*", "SEARCH:*"} {
+			n, err := s.MigrateRedis(pattern)
+			log.Println("migrate cache", pattern, "from redis", n, err)
+		}
+	}
+	every(time.Hour, func() {
+		n, err := s.Expire()
+		if err != nil {
+			log.Println("expire cache", err)
+			return
+		}
+		if n > 0 {
+			log.Println("expire cache", n)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// AuditEntry is a record of destructive operation
+type AuditEntry struct {
+	ID      uint      `json:"id" gorm:"primaryKey"`
+	Time    time.Time `json:"time" gorm:"index"`
+	User    string    `json:"user" gorm:"index"`
+	Remote  string    `json:"remote"`
+	Via     string    `json:"via"` // api or webdav
+	Action  string    `json:"action"`
+	Path    string    `json:"path" gorm:"index"`
+	Dst     string    `json:"dst,omitempty" gorm:"index"`
+	Outcome string    `json:"outcome"` // ok or error
+	Error   string    `json:"error,omitempty"`
+}
+
+// Audit save entry with outcome of err
+func (m *MetaV2) Audit(e *AuditEntry, err error) error {
+	e.Path = strings.TrimLeft(e.Path, "/")
+	e.Dst = strings.TrimLeft(e.Dst, "/")
+	e.Outcome = "ok"
+	if err != nil {
+		e.Outcome = "error"
+		e.Error = err.Error()
+	}
+	return m.db().Create(e).Error
+}
+
+// MovedFrom return path of latest entry moved to dst, like origin of file
+// in trash
+func (m *MetaV2) MovedFrom(dst string) (string, error) {
+	var e AuditEntry
+	err := m.db().Where("dst = ? AND outcome = ?", strings.Trim(dst, "/"), "ok").Order("time desc").Take(&e).Error
+	return e.Path, err
+}
+
+type AuditQuery struct {
+	From  *time.Time
+	To    *time.Time
+	User  string
+	Path  string // path prefix, match path or dst
+	Limit int
+}
+
+// ListAudit list entry match query, newest first
+func (m *MetaV2) ListAudit(q AuditQuery) ([]*AuditEntry, error) {
+	var list []*AuditEntry
+	session := m.db().Session(&gorm.Session{}).Order("time desc")
+	if q.From != nil {
+		session = session.Where("time >= ?", *q.From)
+	}
+	if q.To != nil {
+		session = session.Where("time < ?", *q.To)
+	}
+	if len(q.User) > 0 {
+		session = session.Where("user = ?", q.User)
+	}
+	if path := strings.Trim(q.Path, "/"); len(path) > 0 {
+		session = session.Where("path = ? OR path LIKE ? OR dst = ? OR dst LIKE ?", path, path+"/%", path, path+"/%")
+	}
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 1000
+	}
+	res := session.Limit(q.Limit).Find(&list)
+	return list, res.Error
+}
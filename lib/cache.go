@@ -0,0 +1,229 @@
+package lib
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+)
+
+// cacheNS is in memory lru of a namespace, entry may depend on path,
+// mutation of path evict entry of it, its ancestor and descendant
+type cacheNS struct {
+	name string
+	size int
+	ttl  time.Duration
+
+	mu   sync.Mutex
+	c    gcache.Cache
+	deps map[string]map[string]bool // path to key
+	keys map[string][]string        // key to path
+}
+
+// Namespace is typed cache namespace
+type Namespace[V any] struct {
+	*cacheNS
+}
+
+var (
+	namespaces   = make(map[string]*cacheNS)
+	namespacesMu sync.Mutex
+)
+
+// NewNamespace register namespace with default capacity and ttl
+func NewNamespace[V any](name string, size int, ttl time.Duration) *Namespace[V] {
+	n := &cacheNS{name: name}
+	n.reset(size, ttl)
+	namespacesMu.Lock()
+	namespaces[name] = n
+	namespacesMu.Unlock()
+	return &Namespace[V]{n}
+}
+
+var (
+	SizeCache  = NewNamespace[DirSize]("size", 20000, time.Hour)
+	TitleCache = NewNamespace[string]("title", 20000, 24*time.Hour)
+	ThumbCache = NewNamespace[[]byte]("thumb", 5000, time.Hour)
+	AuthCache  = NewNamespace[string]("auth", 1000, 5*time.Minute)
+)
+
+func (n *cacheNS) reset(size int, ttl time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.size, n.ttl = size, ttl
+	n.c = gcache.New(size).LRU().Build()
+	n.deps = make(map[string]map[string]bool)
+	n.keys = make(map[string][]string)
+}
+
+// SetNamespace change capacity and ttl of namespace, entry dropped
+func SetNamespace(name string, size int, ttl time.Duration) error {
+	namespacesMu.Lock()
+	n, ok := namespaces[name]
+	namespacesMu.Unlock()
+	if !ok {
+		return errors.New("unknown cache namespace " + name)
+	}
+	if size < 1 || ttl <= 0 {
+		return errors.New("cache namespace " + name + " need positive size and ttl")
+	}
+	n.reset(size, ttl)
+	return nil
+}
+
+func (n *cacheNS) cache() gcache.Cache {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.c
+}
+
+func (n *Namespace[V]) Get(key string) (V, bool) {
+	var v V
+	val, err := n.cache().Get(key)
+	if err != nil {
+		return v, false
+	}
+	v, ok := val.(V)
+	return v, ok
+}
+
+// Has check key without count as lookup
+func (n *Namespace[V]) Has(key string) bool {
+	return n.cache().Has(key)
+}
+
+// Set value of key, deps is path relative to root the value depend on
+func (n *Namespace[V]) Set(key string, v V, deps ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.c.SetWithExpire(key, v, n.ttl)
+	n.unlink(key)
+	for _, p := range deps {
+		p = cleanRel(p)
+		if n.deps[p] == nil {
+			n.deps[p] = make(map[string]bool)
+		}
+		n.deps[p][key] = true
+		n.keys[key] = append(n.keys[key], p)
+	}
+	// entry evicted by lru or expired still in index
+	if len(n.keys) > 2*n.size {
+		for k := range n.keys {
+			if !n.c.Has(k) {
+				n.unlink(k)
+			}
+		}
+	}
+}
+
+func (n *cacheNS) Remove(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.c.Remove(key)
+	n.unlink(key)
+}
+
+func (n *cacheNS) unlink(key string) {
+	for _, p := range n.keys[key] {
+		delete(n.deps[p], key)
+		if len(n.deps[p]) == 0 {
+			delete(n.deps, p)
+		}
+	}
+	delete(n.keys, key)
+}
+
+func (n *cacheNS) purge() {
+	n.reset(n.size, n.ttl)
+}
+
+// Invalidate evict entry depend on path, its ancestor or descendant
+func (n *cacheNS) Invalidate(p string) int {
+	p = cleanRel(p)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var keys []string
+	for dep, m := range n.deps {
+		if isRelated(dep, p) {
+			for k := range m {
+				keys = append(keys, k)
+			}
+		}
+	}
+	for _, k := range keys {
+		n.c.Remove(k)
+		n.unlink(k)
+	}
+	return len(keys)
+}
+
+func cleanRel(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// isRelated report if a is b, ancestor or descendant of b
+func isRelated(a, b string) bool {
+	if a == b || len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	return strings.HasPrefix(b, a+"/") || strings.HasPrefix(a, b+"/")
+}
+
+// InvalidatePath evict cache of all namespace affected by change of path
+func InvalidatePath(paths ...string) {
+	namespacesMu.Lock()
+	defer namespacesMu.Unlock()
+	for _, p := range paths {
+		for _, n := range namespaces {
+			n.Invalidate(p)
+		}
+	}
+}
+
+// PurgeCache drop entry of all namespace
+func PurgeCache() {
+	namespacesMu.Lock()
+	defer namespacesMu.Unlock()
+	for _, n := range namespaces {
+		n.purge()
+	}
+}
+
+// CacheStats of namespace
+type CacheStats struct {
+	Name    string  `json:"name"`
+	Len     int     `json:"len"`
+	Size    int     `json:"size"`
+	TTL     string  `json:"ttl"`
+	Hit     uint64  `json:"hit"`
+	Miss    uint64  `json:"miss"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+func ListCacheStats() []*CacheStats {
+	namespacesMu.Lock()
+	defer namespacesMu.Unlock()
+	var list []*CacheStats
+	for _, n := range namespaces {
+		n.mu.Lock()
+		c, size, ttl := n.c, n.size, n.ttl
+		n.mu.Unlock()
+		list = append(list, &CacheStats{
+			Name:    n.name,
+			Len:     c.Len(true),
+			Size:    size,
+			TTL:     ttl.String(),
+			Hit:     c.HitCount(),
+			Miss:    c.MissCount(),
+			HitRate: c.HitRate(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
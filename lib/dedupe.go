@@ -0,0 +1,270 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"gorm.io/gorm"
+)
+
+// bytes read from head and tail of file for partial hash
+const partialHashSize = 64 << 10
+
+// HashValid report if stored hash still match file
+func (i *MetaInfoV2) HashValid() bool {
+	return len(i.FullHash) > 0 && i.HashModTime.Equal(i.ModTime)
+}
+
+func (i *MetaInfoV2) partialValid() bool {
+	return len(i.PartialHash) > 0 && i.HashModTime.Equal(i.ModTime)
+}
+
+// PartialHash hash size, head and tail of file
+func PartialHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, info.Size())
+	if _, err := io.CopyN(h, f, partialHashSize); err != nil && err != io.EOF {
+		return "", err
+	}
+	if info.Size() > 2*partialHashSize {
+		if _, err := f.Seek(-partialHashSize, io.SeekEnd); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FullHash hash whole file, r wrap reader for throttle, nil is not wrapped
+func FullHash(file string, wrap func(io.Reader) io.Reader) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if wrap != nil {
+		r = wrap(f)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// saveHash store hash of row with mod time it computed for
+func (m *MetaV2) saveHash(i *MetaInfoV2) error {
+	return m.db().Model(&MetaInfoV2{}).Where("path = ?", i.Path).Updates(map[string]interface{}{
+		"partial_hash":  i.PartialHash,
+		"full_hash":     i.FullHash,
+		"hash_mod_time": i.ModTime,
+	}).Error
+}
+
+// DupeScan confirm duplicate by size, partial hash then full hash,
+// hash already computed for same mod time reused
+type DupeScan struct {
+	MinSize int64
+	Wrap    func(io.Reader) io.Reader // wrap reader of full hash
+	Hashed  int                       // number of file hashed in this scan
+}
+
+func (m *MetaV2) dupeCandidates(minSize int64) ([][]*MetaInfoV2, error) {
+	var sizes []int64
+	notTrash := "path != dir AND path NOT LIKE '.Trash/%'"
+	res := m.db().Model(&MetaInfoV2{}).Where(notTrash+" AND size >= ?", minSize).
+		Group("size").Having("COUNT(*) > 1").Pluck("size", &sizes)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	var groups [][]*MetaInfoV2
+	for _, size := range sizes {
+		var rows []*MetaInfoV2
+		res := m.db().Where(notTrash+" AND size = ?", size).Find(&rows)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		groups = append(groups, rows)
+	}
+	return groups, nil
+}
+
+// groupBy split rows by key, group of single row dropped
+func groupBy(rows []*MetaInfoV2, key func(*MetaInfoV2) string) [][]*MetaInfoV2 {
+	m := make(map[string][]*MetaInfoV2)
+	for _, i := range rows {
+		if k := key(i); len(k) > 0 {
+			m[k] = append(m[k], i)
+		}
+	}
+	var out [][]*MetaInfoV2
+	for _, v := range m {
+		if len(v) > 1 {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Run hash candidate of duplicate and store hash in db
+func (s *DupeScan) Run(m *MetaV2) error {
+	if s.MinSize < 1 {
+		s.MinSize = 1
+	}
+	groups, err := m.dupeCandidates(s.MinSize)
+	if err != nil {
+		return err
+	}
+	hash := func(i *MetaInfoV2, full bool) string {
+		if err := m.ctx.Err(); err != nil {
+			return ""
+		}
+		if full && i.HashValid() {
+			return i.FullHash
+		}
+		if !full && i.partialValid() {
+			return i.PartialHash
+		}
+		file := filepath.Join(m.root, i.Path)
+		var h string
+		var err error
+		if full {
+			h, err = FullHash(file, s.Wrap)
+			s.Hashed++
+		} else {
+			h, err = PartialHash(file)
+		}
+		if err != nil {
+			return ""
+		}
+		if !i.HashModTime.Equal(i.ModTime) {
+			i.PartialHash, i.FullHash = "", ""
+		}
+		if full {
+			i.FullHash = h
+		} else {
+			i.PartialHash = h
+		}
+		m.saveHash(i)
+		return h
+	}
+	for _, group := range groups {
+		for _, g := range groupBy(group, func(i *MetaInfoV2) string { return hash(i, false) }) {
+			groupBy(g, func(i *MetaInfoV2) string { return hash(i, true) })
+		}
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DupeGroup is file with same content
+type DupeGroup struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Paths  []string `json:"paths"`
+	Wasted int64    `json:"wasted"` // size can be freed keep one copy
+}
+
+// ListDupes return group of duplicate confirmed by full hash under dir,
+// largest wasted first
+func (m *MetaV2) ListDupes(dir string) ([]*DupeGroup, error) {
+	const valid = "full_hash != '' AND hash_mod_time = mod_time AND path NOT LIKE '.Trash/%'"
+	dupes := m.db().Model(&MetaInfoV2{}).Select("full_hash").Where(valid).Group("full_hash").Having("count(*) > 1")
+	if dir = strings.Trim(dir, "/"); len(dir) > 0 && dir != "." {
+		// group with any copy under dir
+		dupes = m.db().Model(&MetaInfoV2{}).Distinct("full_hash").Where(valid).
+			Where("path LIKE ? ESCAPE '\\'", escapeLike(dir)+"/%").
+			Where("full_hash IN (?)", dupes)
+	}
+	var rows []*MetaInfoV2
+	res := m.db().Select("path", "size", "full_hash").Where(valid).Where("full_hash IN (?)", dupes).
+		Order("full_hash, path").Find(&rows)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	groups := make(map[string]*DupeGroup)
+	var list []*DupeGroup
+	for _, i := range rows {
+		g, ok := groups[i.FullHash]
+		if !ok {
+			g = &DupeGroup{Hash: i.FullHash, Size: i.Size}
+			groups[i.FullHash] = g
+			list = append(list, g)
+		}
+		g.Paths = append(g.Paths, i.Path)
+	}
+	var out []*DupeGroup
+	for _, g := range list {
+		// hardlink of same inode take no extra space
+		inodes := make(map[uint64]bool)
+		for _, p := range g.Paths {
+			if f, err := os.Stat(filepath.Join(m.root, p)); err == nil {
+				if st, ok := f.Sys().(*syscall.Stat_t); ok {
+					inodes[uint64(st.Ino)] = true
+				}
+			}
+		}
+		if len(inodes) < 2 {
+			continue
+		}
+		g.Wasted = int64(len(inodes)-1) * g.Size
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Wasted > out[j].Wasted
+	})
+	return out, nil
+}
+
+// DupesOf return other path with same content of path
+func (m *MetaV2) DupesOf(path string) ([]string, error) {
+	i, err := m.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if !i.HashValid() {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var paths []string
+	res := m.db().Model(&MetaInfoV2{}).
+		Where("full_hash = ? AND hash_mod_time = mod_time AND path != ? AND path NOT LIKE '.Trash/%'", i.FullHash, i.Path).
+		Order("path").Pluck("path", &paths)
+	return paths, res.Error
+}
+
+// CopyHash set mod time and hash of dst row from src, after dst replaced
+// by hard link of src
+func (m *MetaV2) CopyHash(dst, src string) error {
+	i, err := m.Get(src)
+	if err != nil {
+		return err
+	}
+	return m.db().Model(&MetaInfoV2{}).Where("path = ?", strings.TrimLeft(dst, "/")).Updates(map[string]interface{}{
+		"size":          i.Size,
+		"mod_time":      i.ModTime,
+		"partial_hash":  i.PartialHash,
+		"full_hash":     i.FullHash,
+		"hash_mod_time": i.HashModTime,
+	}).Error
+}
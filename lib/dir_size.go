@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DirSize is total size of file under dir recursively, root dir is ".",
+// it change with MetaInfoV2 row and rebuild after full index
+type DirSize struct {
+	Dir       string    `json:"dir" gorm:"primaryKey"`
+	Size      int64     `json:"size"`
+	Files     int64     `json:"files"`
+	UpdatedAt time.Time `json:"updated_at"` // last change or verified by index
+}
+
+// state of dir size in list
+const (
+	SizeExact   = "exact"
+	SizeStale   = "stale"   // dir changed after size verified, refreshing
+	SizePending = "pending" // dir not indexed yet
+)
+
+// parentDirs return dir contain path up to root, a/b/c -> a/b, a, .
+func parentDirs(p string) []string {
+	var dirs []string
+	for p != "." && p != "/" && len(p) > 0 {
+		p = filepath.Dir(p)
+		dirs = append(dirs, p)
+	}
+	return dirs
+}
+
+// addSize apply size and file count delta of file to all its parent dir
+func (m *MetaV2) addSize(p string, size, files int64) {
+	if size == 0 && files == 0 {
+		return
+	}
+	now := time.Now()
+	for _, dir := range parentDirs(p) {
+		m.db().Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "dir"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"size":       gorm.Expr("dir_sizes.size + ?", size),
+				"files":      gorm.Expr("dir_sizes.files + ?", files),
+				"updated_at": now,
+			}),
+		}).Create(&DirSize{Dir: dir, Size: size, Files: files, UpdatedAt: now})
+		SizeCache.Remove(dir)
+	}
+}
+
+// rowChanged keep dir size in sync with meta row, nil is not exist
+func (m *MetaV2) rowChanged(old, cur *MetaInfoV2) {
+	if old != nil && cur != nil && old.Path == cur.Path && !old.IsDir() && !cur.IsDir() {
+		m.addSize(cur.Path, cur.Size-old.Size, 0)
+		return
+	}
+	if old == nil && cur != nil && cur.IsDir() {
+		// new dir is empty until file under it indexed
+		m.db().Clauses(clause.OnConflict{DoNothing: true}).Create(&DirSize{Dir: cur.Path, UpdatedAt: time.Now()})
+	}
+	if old != nil && !old.IsDir() {
+		m.addSize(old.Path, -old.Size, -1)
+	}
+	if cur != nil && !cur.IsDir() {
+		m.addSize(cur.Path, cur.Size, 1)
+	}
+}
+
+// RebuildDirSize recount size of all dir from meta rows, fix drift of
+// incremental update
+func (m *MetaV2) RebuildDirSize() error {
+	now := time.Now()
+	sizes := make(map[string]*DirSize)
+	var rows []MetaInfoV2
+	res := m.db().Select("path", "dir", "size").FindInBatches(&rows, 5000, func(tx *gorm.DB, batch int) error {
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		for _, i := range rows {
+			if i.IsDir() {
+				if _, ok := sizes[i.Path]; !ok {
+					sizes[i.Path] = &DirSize{Dir: i.Path, UpdatedAt: now}
+				}
+				continue
+			}
+			for _, dir := range parentDirs(i.Path) {
+				d, ok := sizes[dir]
+				if !ok {
+					d = &DirSize{Dir: dir, UpdatedAt: now}
+					sizes[dir] = d
+				}
+				d.Size += i.Size
+				d.Files++
+			}
+		}
+		return nil
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	list := make([]*DirSize, 0, len(sizes))
+	for _, d := range sizes {
+		list = append(list, d)
+	}
+	err := m.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1 = 1").Delete(&DirSize{}).Error; err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(list, 500).Error
+	})
+	if err == nil {
+		SizeCache.purge()
+	}
+	return err
+}
+
+// touchDirSize mark size of dir and its sub dir verified
+func (m *MetaV2) touchDirSize(prefix string) {
+	prefix = strings.Trim(prefix, "/")
+	session := m.db().Model(&DirSize{})
+	if len(prefix) > 0 && prefix != "." {
+		session = session.Where("dir = ? OR dir LIKE ? ESCAPE '\\'", prefix, escapeLike(prefix)+"/%")
+		SizeCache.Invalidate(prefix)
+	} else {
+		session = session.Where("1 = 1")
+		SizeCache.purge()
+	}
+	session.Update("updated_at", time.Now())
+}
+
+// escapeLike escape wildcard of sqlite like
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetDirSize return size of dir, gorm.ErrRecordNotFound if not indexed
+func (m *MetaV2) GetDirSize(dir string) (*DirSize, error) {
+	dir = strings.Trim(dir, "/")
+	if len(dir) == 0 {
+		dir = "."
+	}
+	if d, ok := SizeCache.Get(dir); ok {
+		return &d, nil
+	}
+	var d DirSize
+	res := m.db().Where("dir = ?", dir).First(&d)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	SizeCache.Set(dir, d, dir)
+	return &d, nil
+}
+
+// SizeState return size of dir and if it is exact, stale or pending,
+// modTime is mod time of dir on disk
+func (m *MetaV2) SizeState(dir string, modTime time.Time) (int64, string) {
+	d, err := m.GetDirSize(dir)
+	if err != nil {
+		return 0, SizePending
+	}
+	if modTime.After(d.UpdatedAt) {
+		return d.Size, SizeStale
+	}
+	return d.Size, SizeExact
+}
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DiskSample is usage of monitored mount at a time
+type DiskSample struct {
+	ID                uint      `json:"-" gorm:"primaryKey"`
+	Time              time.Time `json:"time" gorm:"index"`
+	Path              string    `json:"path" gorm:"index"`
+	Total             uint64    `json:"total"`
+	Used              uint64    `json:"used"`
+	Free              uint64    `json:"free"`
+	UsedPercent       float64   `json:"used_percent"`
+	InodesTotal       uint64    `json:"inodes_total"`
+	InodesUsed        uint64    `json:"inodes_used"`
+	InodesUsedPercent float64   `json:"inodes_used_percent"`
+}
+
+func (m *MetaV2) SaveDiskSamples(list []*DiskSample) error {
+	if len(list) == 0 {
+		return nil
+	}
+	return m.db().Create(list).Error
+}
+
+// DiskQuery of sample history, zero value is not limited
+type DiskQuery struct {
+	Path string
+	From time.Time
+	To   time.Time
+	Step time.Duration // average sample in each step
+}
+
+// ListDiskSamples list sample match query by time, sample of each path
+// averaged in step if step set
+func (m *MetaV2) ListDiskSamples(q DiskQuery) ([]*DiskSample, error) {
+	var list []*DiskSample
+	session := m.db().Session(&gorm.Session{}).Order("time")
+	if len(q.Path) > 0 {
+		session = session.Where("path = ?", q.Path)
+	}
+	if !q.From.IsZero() {
+		session = session.Where("time >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		session = session.Where("time < ?", q.To)
+	}
+	res := session.Find(&list)
+	if res.Error != nil || q.Step <= 0 {
+		return list, res.Error
+	}
+	return averageSamples(list, q.Step), nil
+}
+
+func averageSamples(list []*DiskSample, step time.Duration) []*DiskSample {
+	type bucket struct {
+		sum *DiskSample
+		n   uint64
+	}
+	var out []*DiskSample
+	cur := make(map[string]*bucket)
+	flush := func(path string) {
+		b := cur[path]
+		n := b.n
+		s := b.sum
+		s.Total /= n
+		s.Used /= n
+		s.Free /= n
+		s.UsedPercent /= float64(n)
+		s.InodesTotal /= n
+		s.InodesUsed /= n
+		s.InodesUsedPercent /= float64(n)
+		out = append(out, s)
+		delete(cur, path)
+	}
+	for _, v := range list {
+		t := v.Time.Truncate(step)
+		b, ok := cur[v.Path]
+		if ok && !b.sum.Time.Equal(t) {
+			flush(v.Path)
+			ok = false
+		}
+		if !ok {
+			s := *v
+			s.Time = t
+			cur[v.Path] = &bucket{sum: &s, n: 1}
+			continue
+		}
+		b.sum.Total += v.Total
+		b.sum.Used += v.Used
+		b.sum.Free += v.Free
+		b.sum.UsedPercent += v.UsedPercent
+		b.sum.InodesTotal += v.InodesTotal
+		b.sum.InodesUsed += v.InodesUsed
+		b.sum.InodesUsedPercent += v.InodesUsedPercent
+		b.n++
+	}
+	for path := range cur {
+		flush(path)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+	return out
+}
+
+// PruneDiskSamples delete sample older than t
+func (m *MetaV2) PruneDiskSamples(t time.Time) error {
+	return m.db().Where("time < ?", t).Delete(&DiskSample{}).Error
+}
@@ -0,0 +1,306 @@
+package lib
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// DuItem is dir or file with its size, growth compare to snapshot
+type DuItem struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Files  int64  `json:"files,omitempty"`
+	IsDir  bool   `json:"is_dir"`
+	Growth *int64 `json:"growth,omitempty"`
+}
+
+// DuTotal is total size of extension or label
+type DuTotal struct {
+	Key   string `json:"key"`
+	Size  int64  `json:"size"`
+	Files int64  `json:"files"`
+}
+
+// DuReport is disk usage of dir from index
+type DuReport struct {
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	Files    int64      `json:"files"`
+	Growth   *int64     `json:"growth,omitempty"`
+	Since    *time.Time `json:"since,omitempty"` // time of snapshot compared
+	Children []*DuItem  `json:"children"`        // direct child, for treemap
+	TopDirs  []*DuItem  `json:"top_dirs"`        // largest dir at any depth
+	TopFiles []*DuItem  `json:"top_files"`
+	Exts     []*DuTotal `json:"exts"`
+	Labels   []*DuTotal `json:"labels"`
+}
+
+// DuSnapshot keep size of dir and its direct child at a time
+type DuSnapshot struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	Path      string         `json:"path" gorm:"index"`
+	CreatedAt time.Time      `json:"created_at" gorm:"index"`
+	Sizes     datatypes.JSON `json:"-"` // child path to size, path itself included
+}
+
+func cleanDir(dir string) string {
+	dir = strings.Trim(dir, "/")
+	if len(dir) == 0 {
+		return "."
+	}
+	return dir
+}
+
+// under limit column to path under dir, dir itself excluded
+func under(db *gorm.DB, col, dir string) *gorm.DB {
+	if dir == "." {
+		return db.Where(col + " != '.'")
+	}
+	return db.Where(col+" LIKE ? ESCAPE '\\'", escapeLike(dir)+"/%")
+}
+
+// children return direct child of dir with size
+func (m *MetaV2) duChildren(dir string, keep func(string) bool) ([]*DuItem, error) {
+	var items []*DuItem
+	var dirs []DirSize
+	res := under(m.db(), "dir", dir).Find(&dirs)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	for _, d := range dirs {
+		if filepath.Dir(d.Dir) == dir && keep(d.Dir) {
+			items = append(items, &DuItem{Path: d.Dir, Size: d.Size, Files: d.Files, IsDir: true})
+		}
+	}
+	var files MetaInfoV2s
+	res = m.db().Select("path", "dir", "size").Where("dir = ? AND path != dir", dir).Find(&files)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	for _, f := range files {
+		if keep(f.Path) {
+			items = append(items, &DuItem{Path: f.Path, Size: f.Size})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Size > items[j].Size
+	})
+	return items, nil
+}
+
+// Du report usage of dir, top limit number of largest dir and file,
+// growth compare to snapshot of id, latest snapshot if id is 0,
+// path not keep is left out of list and total of ext and label, size of
+// dir not full is summed from file kept, growth only when dir is full
+func (m *MetaV2) Du(dir string, top int, snapshot uint, keep, full func(string) bool) (*DuReport, error) {
+	dir = cleanDir(dir)
+	rep := &DuReport{Path: dir}
+	var err error
+	if rep.Children, err = m.duChildren(dir, keep); err != nil {
+		return nil, err
+	}
+	var d DirSize
+	err = m.duTop(under(m.db().Model(&DirSize{}), "dir", dir).Order("size desc"), &d, func() bool {
+		if !keep(d.Dir) || !full(d.Dir) {
+			return false
+		}
+		rep.TopDirs = append(rep.TopDirs, &DuItem{Path: d.Dir, Size: d.Size, Files: d.Files, IsDir: true})
+		return len(rep.TopDirs) >= top
+	})
+	if err != nil {
+		return nil, err
+	}
+	var f MetaInfoV2
+	err = m.duTop(under(m.db().Model(&MetaInfoV2{}), "path", dir).Select("path", "dir", "size").Where("path != dir").Order("size desc"), &f, func() bool {
+		if !keep(f.Path) {
+			return false
+		}
+		rep.TopFiles = append(rep.TopFiles, &DuItem{Path: f.Path, Size: f.Size})
+		return len(rep.TopFiles) >= top
+	})
+	if err != nil {
+		return nil, err
+	}
+	sum, err := m.duTotals(dir, keep)
+	if err != nil {
+		return nil, err
+	}
+	rep.Exts, rep.Labels = sortTotals(sum.exts), sortTotals(sum.labels)
+	if !full(dir) {
+		rep.Size, rep.Files = sum.size, sum.files
+		for _, c := range rep.Children {
+			if c.IsDir && !full(c.Path) {
+				c.Size, c.Files = 0, 0
+				if t, ok := sum.dirs[c.Path]; ok {
+					c.Size, c.Files = t.Size, t.Files
+				}
+			}
+		}
+		sort.Slice(rep.Children, func(i, j int) bool {
+			return rep.Children[i].Size > rep.Children[j].Size
+		})
+		return rep, nil
+	}
+	total, err := m.GetDirSize(dir)
+	if err != nil {
+		return nil, err
+	}
+	rep.Size, rep.Files = total.Size, total.Files
+	snap, err := m.GetDuSnapshot(dir, snapshot)
+	if err == nil {
+		rep.compare(snap)
+	} else if snapshot > 0 {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// duTop scan row of query into dst one by one until f return true
+func (m *MetaV2) duTop(query *gorm.DB, dst interface{}, f func() bool) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := m.db().ScanRows(rows, dst); err != nil {
+			return err
+		}
+		if f() {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+type duSum struct {
+	size   int64
+	files  int64
+	exts   map[string]*DuTotal
+	labels map[string]*DuTotal
+	dirs   map[string]*DuTotal // direct child dir
+}
+
+// duTotals sum size of file kept under dir, by extension, label and direct
+// child dir, extension in lower case
+func (m *MetaV2) duTotals(dir string, keep func(string) bool) (*duSum, error) {
+	sum := &duSum{
+		exts:   make(map[string]*DuTotal),
+		labels: make(map[string]*DuTotal),
+		dirs:   make(map[string]*DuTotal),
+	}
+	add := func(totals map[string]*DuTotal, key string, size int64) {
+		t, ok := totals[key]
+		if !ok {
+			t = &DuTotal{Key: key}
+			totals[key] = t
+		}
+		t.Size += size
+		t.Files++
+	}
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	var rows MetaInfoV2s
+	res := under(m.db(), "path", dir).Select("path", "dir", "size", "label").Where("path != dir").FindInBatches(&rows, 5000, func(tx *gorm.DB, batch int) error {
+		for _, f := range rows {
+			if !keep(f.Path) {
+				continue
+			}
+			sum.size += f.Size
+			sum.files++
+			add(sum.exts, strings.ToLower(filepath.Ext(f.Path)), f.Size)
+			add(sum.labels, f.Label, f.Size)
+			if p := strings.SplitN(strings.TrimPrefix(f.Path, prefix), "/", 2); len(p) == 2 {
+				add(sum.dirs, prefix+p[0], f.Size)
+			}
+		}
+		return nil
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return sum, nil
+}
+
+func sortTotals(totals map[string]*DuTotal) []*DuTotal {
+	list := make([]*DuTotal, 0, len(totals))
+	for _, t := range totals {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Size > list[j].Size
+	})
+	return list
+}
+
+func (rep *DuReport) compare(snap *DuSnapshot) {
+	var sizes map[string]int64
+	if err := json.Unmarshal(snap.Sizes, &sizes); err != nil {
+		return
+	}
+	growth := func(p string, size int64) *int64 {
+		g := size - sizes[p]
+		return &g
+	}
+	rep.Since = &snap.CreatedAt
+	rep.Growth = growth(rep.Path, rep.Size)
+	for _, c := range rep.Children {
+		c.Growth = growth(c.Path, c.Size)
+	}
+}
+
+// SnapshotDu save size of dir and its direct child
+func (m *MetaV2) SnapshotDu(dir string) (*DuSnapshot, error) {
+	dir = cleanDir(dir)
+	total, err := m.GetDirSize(dir)
+	if err != nil {
+		return nil, err
+	}
+	children, err := m.duChildren(dir, func(string) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+	sizes := map[string]int64{dir: total.Size}
+	for _, c := range children {
+		sizes[c.Path] = c.Size
+	}
+	b, err := json.Marshal(sizes)
+	if err != nil {
+		return nil, err
+	}
+	snap := &DuSnapshot{Path: dir, CreatedAt: time.Now(), Sizes: datatypes.JSON(b)}
+	return snap, m.db().Create(snap).Error
+}
+
+// GetDuSnapshot return snapshot of id, or latest snapshot of dir if id is 0
+func (m *MetaV2) GetDuSnapshot(dir string, id uint) (*DuSnapshot, error) {
+	var snap DuSnapshot
+	session := m.db().Where("path = ?", cleanDir(dir))
+	if id > 0 {
+		session = session.Where("id = ?", id)
+	}
+	res := session.Order("created_at desc").First(&snap)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return &snap, nil
+}
+
+func (m *MetaV2) ListDuSnapshots(dir string) ([]*DuSnapshot, error) {
+	var list []*DuSnapshot
+	res := m.db().Where("path = ?", cleanDir(dir)).Order("created_at desc").Find(&list)
+	return list, res.Error
+}
+
+// PruneDuSnapshots delete snapshot older than t
+func (m *MetaV2) PruneDuSnapshots(t time.Time) error {
+	return m.db().Where("created_at < ?", t).Delete(&DuSnapshot{}).Error
+}
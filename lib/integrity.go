@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// integrity of file, valid when HashModTime equal ModTime
+const (
+	IntegrityOK       = "ok"
+	IntegrityMismatch = "mismatch" // hash differ from sidecar checksum
+	IntegrityCorrupt  = "corrupt"  // content changed but mod time not
+)
+
+// IntegrityState return integrity of file, empty if not verified since
+// last change
+func (i *MetaInfoV2) IntegrityState() string {
+	if !i.HashModTime.Equal(i.ModTime) {
+		return ""
+	}
+	return i.Integrity
+}
+
+// Checksum is expected hash of file from sidecar
+type Checksum struct {
+	Algo    string // crc32, md5 or sha256
+	Hash    string // lower case hex
+	Sidecar string // path of sidecar
+}
+
+func sidecarAlgo(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".sfv":
+		return "crc32"
+	case ".md5":
+		return "md5"
+	case ".sha256":
+		return "sha256"
+	}
+	return ""
+}
+
+// IsSidecar report if path is checksum file
+func IsSidecar(p string) bool {
+	return len(sidecarAlgo(p)) > 0
+}
+
+// bsd style, MD5 (file) = hash
+var bsdSum = regexp.MustCompile(`^(?:MD5|SHA256) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+
+// ParseSidecar read checksum of sidecar, key is path relative to root,
+// sfv line is "file crc", md5 and sha256 line is "hash  file" or bsd style
+func ParseSidecar(root, p string) (map[string]*Checksum, error) {
+	algo := sidecarAlgo(p)
+	if len(algo) == 0 {
+		return nil, fmt.Errorf("%s is not sidecar", p)
+	}
+	f, err := os.Open(filepath.Join(root, p))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir := filepath.Dir(p)
+	out := make(map[string]*Checksum)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if len(line) == 0 || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		var name, sum string
+		if m := bsdSum.FindStringSubmatch(line); m != nil {
+			name, sum = m[1], m[2]
+		} else if algo == "crc32" {
+			i := strings.LastIndexAny(line, " \t")
+			if i < 0 {
+				continue
+			}
+			name, sum = strings.TrimSpace(line[:i]), line[i+1:]
+		} else {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				continue
+			}
+			sum, name = line[:i], strings.TrimLeft(line[i:], " \t")
+			name = strings.TrimPrefix(name, "*")
+		}
+		name = strings.ReplaceAll(name, `\`, "/")
+		if len(name) == 0 || len(sum) == 0 {
+			continue
+		}
+		out[filepath.Join(dir, name)] = &Checksum{Algo: algo, Hash: strings.ToLower(sum), Sidecar: p}
+	}
+	return out, scanner.Err()
+}
+
+func newHash(algo string) hash.Hash {
+	switch algo {
+	case "crc32":
+		return crc32.NewIEEE()
+	case "md5":
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// Scrub rehash file and check it against sidecar and hash stored by last
+// scrub, file least recently verified first
+type Scrub struct {
+	Prefix   string                    // only file under prefix, empty is all
+	Wrap     func(io.Reader) io.Reader // wrap reader for throttle
+	Verified int
+	Mismatch int
+	Corrupt  int
+}
+
+// sidecars load checksum of all sidecar under prefix
+func (s *Scrub) sidecars(m *MetaV2) (map[string]*Checksum, error) {
+	var paths []string
+	session := m.db().Model(&MetaInfoV2{}).Where("path != dir AND path NOT LIKE '.Trash/%'").
+		Where("path LIKE '%.sfv' OR path LIKE '%.md5' OR path LIKE '%.sha256'")
+	if dir := cleanDir(s.Prefix); dir != "." {
+		session = session.Where("path LIKE ? ESCAPE '\\'", escapeLike(dir)+"/%")
+	}
+	if err := session.Pluck("path", &paths).Error; err != nil {
+		return nil, err
+	}
+	out := make(map[string]*Checksum)
+	for _, p := range paths {
+		sums, err := ParseSidecar(m.root, p)
+		if err != nil {
+			continue
+		}
+		for k, v := range sums {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// Run scrub file verified before start of run
+func (s *Scrub) Run(m *MetaV2) error {
+	sums, err := s.sidecars(m)
+	if err != nil {
+		return err
+	}
+	// row from before scrub added has no verified_at
+	m.db().Model(&MetaInfoV2{}).Where("verified_at IS NULL").Update("verified_at", time.Time{})
+	start := time.Now()
+	var last MetaInfoV2
+	for {
+		if err := m.ctx.Err(); err != nil {
+			return err
+		}
+		session := m.db().Where("path != dir AND path NOT LIKE '.Trash/%' AND verified_at < ?", start)
+		if dir := cleanDir(s.Prefix); dir != "." {
+			session = session.Where("path LIKE ? ESCAPE '\\'", escapeLike(dir)+"/%")
+		}
+		if len(last.Path) > 0 {
+			// file skipped keep old verified_at, continue after it
+			session = session.Where("verified_at > ? OR (verified_at = ? AND path > ?)", last.VerifiedAt, last.VerifiedAt, last.Path)
+		}
+		var rows []*MetaInfoV2
+		if err := session.Order("verified_at, path").Limit(200).Find(&rows).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for _, i := range rows {
+			if err := m.ctx.Err(); err != nil {
+				return err
+			}
+			s.verify(m, i, sums[i.Path])
+		}
+		last = *rows[len(rows)-1]
+	}
+}
+
+// verify hash file and save integrity, file changed since indexed or
+// during hash is skipped
+func (s *Scrub) verify(m *MetaV2, i *MetaInfoV2, sum *Checksum) {
+	file := filepath.Join(m.root, i.Path)
+	info, err := os.Stat(file)
+	if err != nil || !info.ModTime().Equal(i.ModTime) || info.Size() != i.Size {
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if s.Wrap != nil {
+		r = s.Wrap(f)
+	}
+	full := sha256.New()
+	w := io.Writer(full)
+	var side hash.Hash
+	if sum != nil && sum.Algo != "sha256" {
+		side = newHash(sum.Algo)
+		w = io.MultiWriter(full, side)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return
+	}
+	if info, err := os.Stat(file); err != nil || !info.ModTime().Equal(i.ModTime) {
+		return
+	}
+	h := hex.EncodeToString(full.Sum(nil))
+	state := IntegrityOK
+	by := "scrub"
+	if i.HashValid() && i.FullHash != h {
+		// keep hash of last scrub, it stay corrupt until file rewrite
+		state = IntegrityCorrupt
+		h = i.FullHash
+		s.Corrupt++
+	}
+	if sum != nil {
+		got := h
+		if side != nil {
+			got = hex.EncodeToString(side.Sum(nil))
+		}
+		by = sum.Sidecar
+		if got != sum.Hash {
+			state = IntegrityMismatch
+			s.Mismatch++
+		}
+	}
+	updates := map[string]interface{}{
+		"full_hash":     h,
+		"hash_mod_time": i.ModTime,
+		"integrity":     state,
+		"verified_by":   by,
+		"verified_at":   time.Now(),
+	}
+	if !i.HashModTime.Equal(i.ModTime) {
+		updates["partial_hash"] = ""
+	}
+	m.db().Model(&MetaInfoV2{}).Where("path = ?", i.Path).Updates(updates)
+	s.Verified++
+}
+
+// ListIntegrity return integrity of file in dir, key is path
+func (m *MetaV2) ListIntegrity(dir string) (map[string]string, error) {
+	var rows []*MetaInfoV2
+	res := m.db().Select("path", "mod_time", "hash_mod_time", "integrity").
+		Where("dir = ? AND path != dir AND integrity != ''", cleanDir(dir)).Find(&rows)
+	out := make(map[string]string)
+	for _, i := range rows {
+		if s := i.IntegrityState(); len(s) > 0 {
+			out[i.Path] = s
+		}
+	}
+	return out, res.Error
+}
+
+// ListBroken return file under dir fail verification
+func (m *MetaV2) ListBroken(dir string) (MetaInfoV2s, error) {
+	var list MetaInfoV2s
+	session := m.db().Session(&gorm.Session{}).
+		Where("integrity IN ? AND hash_mod_time = mod_time", []string{IntegrityMismatch, IntegrityCorrupt})
+	if dir = cleanDir(dir); dir != "." {
+		session = session.Where("path LIKE ? ESCAPE '\\'", escapeLike(dir)+"/%")
+	}
+	res := session.Order("path").Find(&list)
+	return list, res.Error
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// KVBackend store value with ttl, zero ttl never expire
+type KVBackend interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration) error
+	Del(key string) error
+}
+
+// KVStore gob encode value on top of backend
+type KVStore struct {
+	KVBackend
+	Name string
+}
+
+// KV is cache of meta and search result, set by InitKV
+var KV *KVStore
+
+// InitKV select backend, redis or sqlite in meta db
+func InitKV(backend string, m *MetaV2) error {
+	switch backend {
+	case "redis":
+		if len(RedisHost) == 0 {
+			return errors.New("cache redis need redis host")
+		}
+		InitRedisPool()
+		KV = &KVStore{KVBackend: Redis, Name: backend}
+	case "sqlite":
+		KV = &KVStore{KVBackend: &SqliteKV{m: m}, Name: backend}
+	default:
+		return errors.New("unknown cache backend " + backend)
+	}
+	log.Println("cache backend", backend)
+	return nil
+}
+
+func (s *KVStore) GetValue(key string, value interface{}) bool {
+	by, b := s.Get(key)
+	if !b {
+		return b
+	}
+	err := gob.NewDecoder(bytes.NewBuffer(by)).Decode(value)
+	if err != nil {
+		log.Println(key, err)
+		return false
+	}
+	return true
+}
+
+func (s *KVStore) SetValueWithTTL(key string, value interface{}, second int) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	if err != nil {
+		return err
+	}
+	return s.Set(key, buf.Bytes(), time.Duration(second)*time.Second)
+}
+
+// KVEntry is row of sqlite backend, value is same gob bytes as redis
+type KVEntry struct {
+	Key       string `gorm:"primaryKey"`
+	Value     []byte
+	ExpiresAt *time.Time `gorm:"index"`
+}
+
+// SqliteKV keep cache in meta db, no extra service needed
+type SqliteKV struct {
+	m *MetaV2
+}
+
+func (s *SqliteKV) Get(key string) ([]byte, bool) {
+	var e KVEntry
+	res := s.m.db().Where("key = ?", key).First(&e)
+	if res.Error != nil {
+		if !errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			log.Println("kv", res.Error)
+		}
+		return nil, false
+	}
+	if e.ExpiresAt != nil && time.Now().After(*e.ExpiresAt) {
+		s.Del(key)
+		return nil, false
+	}
+	return e.Value, true
+}
+
+func (s *SqliteKV) Set(key string, value []byte, ttl time.Duration) error {
+	e := KVEntry{Key: key, Value: value}
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		e.ExpiresAt = &t
+	}
+	return s.m.db().Clauses(clause.OnConflict{UpdateAll: true}).Create(&e).Error
+}
+
+func (s *SqliteKV) Del(key string) error {
+	return s.m.db().Where("key = ?", key).Delete(&KVEntry{}).Error
+}
+
+// Expire delete expired entry, return number deleted
+func (s *SqliteKV) Expire() (int64, error) {
+	res := s.m.db().Where("expires_at < ?", time.Now()).Delete(&KVEntry{})
+	return res.RowsAffected, res.Error
+}
+
+// MigrateRedis copy key match pattern from redis to sqlite with remain ttl,
+// entry already in sqlite not overwrite
+func (s *SqliteKV) MigrateRedis(pattern string) (int, error) {
+	if Redis == nil {
+		InitRedisPool()
+	}
+	conn := Redis.Pool.Get()
+	defer conn.Close()
+	var n int
+	cursor := "0"
+	for {
+		res, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return n, err
+		}
+		cursor, _ = redis.String(res[0], nil)
+		keys, _ := redis.Strings(res[1], nil)
+		for _, k := range keys {
+			if _, ok := s.Get(k); ok {
+				continue
+			}
+			b, err := redis.Bytes(conn.Do("GET", k))
+			if err != nil {
+				continue
+			}
+			// -1 no expire, -2 gone
+			pttl, err := redis.Int64(conn.Do("PTTL", k))
+			if err != nil || pttl == -2 {
+				continue
+			}
+			var ttl time.Duration
+			if pttl > 0 {
+				ttl = time.Duration(pttl) * time.Millisecond
+			}
+			if err := s.Set(k, b, ttl); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if cursor == "0" {
+			return n, nil
+		}
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/bluele/gcache"
 	//_ "github.com/mattn/go-sqlite3"
 	"gorm.io/datatypes"
 	"gorm.io/driver/sqlite"
@@ -20,8 +19,6 @@ import (
 	"gorm.io/gorm/logger"
 )
 
-var Cache = gcache.New(20000).LRU().Build()
-
 func (m *MetaV2) dbOrgPath() string {
 	return filepath.Join(m.root, ".kfs.db")
 }
@@ -128,7 +125,7 @@ func (m *MetaV2) db() *gorm.DB {
 }
 
 func (m *MetaV2) init() error {
-	tables := []interface{}{MetaInfoV2{}}
+	tables := []interface{}{MetaInfoV2{}, WatchProgress{}, Share{}, User{}, Token{}, AuditEntry{}, KVEntry{}, DirSize{}, DuSnapshot{}, DiskSample{}, TorrentJob{}, DeadLetter{}}
 	var errs error
 	for _, v := range tables {
 		err := m.db().AutoMigrate(v)
@@ -143,12 +140,16 @@ type MetaV2 struct {
 	*gorm.DB
 	root  string
 	dbDir string
+	ctx   context.Context // stop index and orphan walk when done
+	// called with created, changed or removed when index find change
+	onIndex func(action string, i *MetaInfoV2)
 }
 
 func NewMetaV2(root, dbDir string) *MetaV2 {
 	m := MetaV2{
 		root:  root,
 		dbDir: dbDir,
+		ctx:   context.Background(),
 	}
 	err := m.init()
 	if err != nil {
@@ -157,6 +158,23 @@ func NewMetaV2(root, dbDir string) *MetaV2 {
 	return &m
 }
 
+// BindContext stop long running index when ctx done
+func (m *MetaV2) BindContext(ctx context.Context) {
+	m.ctx = ctx
+}
+
+// OnIndex set func called when index or orphan check find change, set it
+// before index start
+func (m *MetaV2) OnIndex(f func(action string, i *MetaInfoV2)) {
+	m.onIndex = f
+}
+
+func (m *MetaV2) indexed(action string, i *MetaInfoV2) {
+	if m.onIndex != nil {
+		m.onIndex(action, i)
+	}
+}
+
 func (m *MetaV2) LoadPath(relPath string) (*MetaInfoV2, error) {
 	info, err := os.Stat(filepath.Join(m.root, relPath))
 	if err != nil {
@@ -177,6 +195,7 @@ func (m *MetaV2) MoveDir(srcDir, dstDir string) error {
 		return err
 	}
 	for _, i := range infos {
+		org := i
 		orgPath := i.Path
 		dirBase := filepath.Base(i.Dir)
 		dstPath := filepath.Join(dstDir, dirBase, filepath.Base(i.Path))
@@ -189,6 +208,36 @@ func (m *MetaV2) MoveDir(srcDir, dstDir string) error {
 		i.OldLoc = orgPath
 		m.Set(&i)
 		m.db().Where("path = ?", orgPath).Delete(&MetaInfoV2{})
+		m.rowChanged(&org, nil)
+	}
+	return nil
+}
+
+// MovePath("a/b", "c/d") -> rename a/b and everything under it to c/d
+func (m *MetaV2) MovePath(src, dst string) error {
+	src = strings.Trim(src, "/")
+	dst = strings.Trim(dst, "/")
+
+	infos, err := m.List(MetaV2ListOptions{Prefix: &src})
+	if err != nil {
+		return err
+	}
+	for _, i := range infos {
+		if i.Path != src && !strings.HasPrefix(i.Path, src+"/") {
+			continue
+		}
+		org := i
+		orgPath := i.Path
+		isDir := i.IsDir()
+		i.Path = dst + strings.TrimPrefix(i.Path, src)
+		if isDir {
+			i.Dir = i.Path
+		} else {
+			i.Dir = filepath.Dir(i.Path)
+		}
+		m.db().Where("path = ?", orgPath).Delete(&MetaInfoV2{})
+		m.rowChanged(&org, nil)
+		m.Set(&i)
 	}
 	return nil
 }
@@ -214,6 +263,7 @@ func (m *MetaV2) NewInfo(path string, info os.FileInfo) (*MetaInfoV2, bool, erro
 			ModTime: info.ModTime(),
 		}
 		m.Set(i)
+		m.indexed("created", i)
 		return i, true, nil
 	}
 	if i.ModTime.Equal(info.ModTime()) && i.Size == info.Size() {
@@ -226,9 +276,12 @@ func (m *MetaV2) NewInfo(path string, info os.FileInfo) (*MetaInfoV2, bool, erro
 		} else {
 			log.Println("update", path, i.ModTime.Format(time.RFC3339), "->", info.ModTime().Format(time.RFC3339), i.Size, "->", info.Size())
 		}
+		old := *i
 		i.Size = info.Size()
 		i.ModTime = info.ModTime()
 		m.db().Updates(i)
+		m.rowChanged(&old, i)
+		m.indexed("changed", i)
 		return i, true, nil
 	}
 }
@@ -257,7 +310,15 @@ type MetaInfoV2 struct {
 	Icons   datatypes.JSON `json:"icons"`
 	OldLoc  string
 	Context datatypes.JSON
-	MetaV2  *MetaV2 `xorm:"-" gorm:"-"`
+	// content hash for dedupe, valid when HashModTime equal ModTime
+	PartialHash string    `json:"-" gorm:"index"`
+	FullHash    string    `json:"-" gorm:"index"`
+	HashModTime time.Time `json:"-"`
+	// result of last scrub, valid when HashModTime equal ModTime
+	Integrity  string    `json:"integrity"`
+	VerifiedBy string    `json:"verified_by"` // sidecar path or scrub
+	VerifiedAt time.Time `json:"verified_at" gorm:"index"`
+	MetaV2     *MetaV2   `xorm:"-" gorm:"-"`
 }
 
 // SetContext sets the context map to the Context field
@@ -312,6 +373,9 @@ func (m *MetaV2) Index(prefixs ...string) error {
 	for _, prefix := range prefixs {
 		prefix = strings.TrimLeft(prefix, "/")
 		err := filepath.Walk(filepath.Join(m.root, prefix), func(path string, info os.FileInfo, err error) error {
+			if err := m.ctx.Err(); err != nil {
+				return err
+			}
 			path, err = filepath.Rel(m.root, path)
 			if err != nil {
 				return err
@@ -322,6 +386,7 @@ func (m *MetaV2) Index(prefixs ...string) error {
 		if err != nil {
 			return err
 		}
+		m.touchDirSize(prefix)
 	}
 	return nil
 }
@@ -335,6 +400,9 @@ func (m *MetaV2) IndexDynamicly(prefixs ...string) error {
 	for _, prefix := range prefixs {
 		prefix = strings.TrimLeft(prefix, "/")
 		err := filepath.Walk(filepath.Join(m.root, prefix), func(path string, info os.FileInfo, err error) error {
+			if err := m.ctx.Err(); err != nil {
+				return err
+			}
 			path, err = filepath.Rel(m.root, path)
 			if err != nil {
 				return err
@@ -350,13 +418,16 @@ func (m *MetaV2) IndexDynamicly(prefixs ...string) error {
 		}
 	}
 	if recheck {
-		time.Sleep(10 * time.Second)
-		for _, prefix := range prefixs {
-			prefix = strings.TrimLeft(prefix, "/")
-			Cache.Remove("size:" + prefix)
+		select {
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		case <-time.After(10 * time.Second):
 		}
 		return m.IndexDynamicly(prefixs...)
 	}
+	for _, prefix := range prefixs {
+		m.touchDirSize(prefix)
+	}
 	return nil
 }
 
@@ -370,86 +441,56 @@ func (m *MetaV2) RemoveOrphan(prefixs ...string) error {
 			return err
 		}
 		for _, i := range is {
+			if err := m.ctx.Err(); err != nil {
+				return err
+			}
 			if _, err := os.Stat(filepath.Join(m.root, i.Path)); err != nil {
 				m.Del(i.Path)
+				m.indexed("removed", &i)
 			}
 		}
 	}
 	return nil
 }
 
-func (m *MetaV2) CacheSize() error {
-	var infos MetaInfoV2s
-	res := m.db().Distinct("dir").Find(&infos)
-	if res.Error != nil {
-		return res.Error
+// Close checkpoint wal and close database, MetaV2 can not be used after
+func (m *MetaV2) Close() error {
+	if m.DB == nil {
+		return nil
 	}
-	for _, i := range infos {
-		size, err := m.Size(i.Dir)
-		if err != nil {
-			return err
-		}
-		Cache.SetWithExpire("size:"+i.Dir, size, time.Hour)
+	if err := m.DB.Exec("PRAGMA wal_checkpoint(TRUNCATE);").Error; err != nil {
+		log.Println(err)
 	}
-
-	return nil
-}
-
-func (m *MetaV2) Close() error {
-	m.DB = nil
-	return nil
+	db, err := m.DB.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
 }
 
 type MetaV2ListOptions struct {
-	Prefix *string
+	Prefix *string // path itself and everything under it, empty is all
 }
 
 func (m *MetaV2) List(opts MetaV2ListOptions) (MetaInfoV2s, error) {
 	var list MetaInfoV2s
 	session := m.db().Session(&gorm.Session{})
 	if opts.Prefix != nil {
-		session = session.Where("path like ?", *opts.Prefix+"%")
+		if prefix := strings.Trim(*opts.Prefix, "/"); len(prefix) > 0 && prefix != "." {
+			session = session.Where("path = ? OR path LIKE ? ESCAPE '\\'", prefix, escapeLike(prefix)+"/%")
+		}
 	}
 	res := session.Find(&list)
 	return list, res.Error
 }
 
-func (m *MetaV2) Size(prefix string) (float64, error) {
-	var sumSize int64
-	m.db().Model(MetaInfoV2{}).Select("SUM(size) as size").Where("path LIKE ?", prefix+"%").Find(&sumSize)
-	if sumSize == 0 {
-		// m.Index(prefix)
-		go m.IndexDynamicly(prefix)
-		time.Sleep(100 * time.Millisecond)
-		m.db().Model(MetaInfoV2{}).Select("SUM(size) as size").Where("path LIKE ?", prefix+"%").Find(&sumSize)
-		return float64(sumSize), nil
-	}
-	return float64(sumSize), nil
-}
-
-func (m *MetaV2) SizeWithTimeout(prefix string, ctx context.Context) (float64, error) {
-	resultChan := make(chan float64)
-	errChan := make(chan error)
-
-	// Run Query in a goroutine so that it can be executed concurrently
-	go func() {
-		result, err := m.Size(prefix)
-		if err != nil {
-			errChan <- err
-			return
-		}
-		resultChan <- result
-	}()
-
-	// Use select to wait on multiple channel operations.
-	select {
-	case result := <-resultChan:
-		return result, nil
-	case err := <-errChan:
-		return 1, err
-	case <-ctx.Done():
-		return 2, ctx.Err() // Return default value and the context error
+// Size return total size of file under dir
+func (m *MetaV2) Size(dir string) (int64, error) {
+	d, err := m.GetDirSize(dir)
+	if err != nil {
+		return 0, err
 	}
+	return d.Size, nil
 }
 
 func (m *MetaV2) Set(val *MetaInfoV2) *MetaInfoV2 {
@@ -458,11 +499,22 @@ func (m *MetaV2) Set(val *MetaInfoV2) *MetaInfoV2 {
 	}
 	val.Path = strings.TrimLeft(val.Path, "/")
 	val.Dir = strings.TrimLeft(val.Dir, "/")
-	_, err := m.Get(val.Path)
+	old, err := m.Get(val.Path)
 	if err != nil {
-		m.db().Create(val)
+		if m.db().Create(val).Error == nil {
+			m.rowChanged(nil, val)
+		}
 	} else {
 		m.db().Updates(val)
+		// zero value not updated
+		cur := *old
+		if val.Size != 0 {
+			cur.Size = val.Size
+		}
+		if len(val.Dir) > 0 {
+			cur.Dir = val.Dir
+		}
+		m.rowChanged(old, &cur)
 	}
 	val.MetaV2 = m
 	return val
@@ -474,8 +526,14 @@ func (m *MetaV2) Del(path string) {
 		return
 	}
 	if info.IsDir() {
+		var rows MetaInfoV2s
+		m.db().Where("dir = ?", path).Find(&rows)
 		m.db().Where("dir = ?", path).Delete(&MetaInfoV2{})
+		for _, i := range rows {
+			m.rowChanged(&i, nil)
+		}
 	} else {
 		m.db().Where("path = ?", path).Delete(&MetaInfoV2{})
+		m.rowChanged(info, nil)
 	}
 }
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+// WatchedRatio position/duration over this ratio mark the video as watched
+const WatchedRatio = 0.9
+
+// WatchProgress playback position of a video per user
+type WatchProgress struct {
+	Path      string    `json:"path" gorm:"primaryKey"`
+	User      string    `json:"user" gorm:"primaryKey"`
+	Position  float64   `json:"position"`
+	Duration  float64   `json:"duration"`
+	Watched   bool      `json:"watched"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Progress return position/duration in 0..1
+func (p *WatchProgress) Progress() float64 {
+	if p.Watched {
+		return 1
+	}
+	if p.Duration <= 0 {
+		return 0
+	}
+	return p.Position / p.Duration
+}
+
+func (m *MetaV2) GetProgress(path, user string) (*WatchProgress, error) {
+	path = strings.TrimLeft(path, "/")
+	var p WatchProgress
+	res := m.db().Where("path = ? AND user = ?", path, user).First(&p)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return &p, nil
+}
+
+func (m *MetaV2) SetProgress(p *WatchProgress) error {
+	p.Path = strings.TrimLeft(p.Path, "/")
+	if p.Duration > 0 && p.Position/p.Duration >= WatchedRatio {
+		p.Watched = true
+	}
+	p.UpdatedAt = time.Now()
+	return m.db().Save(p).Error
+}
+
+// ListProgress return progress of all video under prefix, key by path
+func (m *MetaV2) ListProgress(prefix, user string) (map[string]*WatchProgress, error) {
+	prefix = strings.TrimLeft(prefix, "/")
+	var list []*WatchProgress
+	session := m.db().Session(&gorm.Session{}).Where("user = ?", user)
+	if len(prefix) > 0 {
+		session = session.Where("path LIKE ? ESCAPE '\\'", escapeLike(prefix)+"/%")
+	}
+	res := session.Find(&list)
+	out := make(map[string]*WatchProgress)
+	for _, p := range list {
+		out[p.Path] = p
+	}
+	return out, res.Error
+}
+
+// CountUnwatched return number of unwatched video with ext in exts under
+// each direct sub dir of prefix, key by path of sub dir
+func (m *MetaV2) CountUnwatched(prefix, user string, exts []string) (map[string]int, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "." {
+		prefix = ""
+	}
+	out := make(map[string]int)
+	if len(exts) == 0 {
+		return out, nil
+	}
+	// path relative to prefix, first part of it is the sub dir
+	rel := "path"
+	session := m.db().Model(&MetaInfoV2{})
+	if len(prefix) > 0 {
+		// substr of sqlite count character, not byte
+		rel = fmt.Sprintf("substr(path, %d)", utf8.RuneCountInString(prefix)+2)
+		session = session.Where("path LIKE ? ESCAPE '\\'", escapeLike(prefix)+"/%")
+	}
+	var ext []string
+	var args []interface{}
+	for _, v := range exts {
+		ext = append(ext, "path LIKE ? ESCAPE '\\'")
+		args = append(args, "%"+escapeLike(v))
+	}
+	watched := m.db().Model(&WatchProgress{}).Select("path").Where("user = ? AND watched = ?", user, true)
+	var rows []struct {
+		Child string
+		N     int
+	}
+	res := session.
+		Select("substr("+rel+", 1, instr("+rel+", '/') - 1) AS child, count(*) AS n").
+		Where("path != dir AND instr("+rel+", '/') > 0").
+		Where(strings.Join(ext, " OR "), args...).
+		Where("path NOT IN (?)", watched).
+		Group("child").
+		Scan(&rows)
+	for _, r := range rows {
+		if len(prefix) > 0 {
+			r.Child = prefix + "/" + r.Child
+		}
+		out[r.Child] = r.N
+	}
+	return out, res.Error
+}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestCountUnwatched(t *testing.T) {
+	m := NewMetaV2(t.TempDir(), t.TempDir())
+	defer m.Close()
+	for _, p := range []string{
+		"动画/第一季/e1.mp4",
+		"动画/第一季/e2.mp4",
+		"动画/第二季/e1.mkv",
+		"动画/第二季/cover.jpg",
+		"动画/第二季/sp/e0.MP4",
+		"动画/root.mp4",
+		"动画x/a/e1.mp4",
+		"show/s1/e1.mp4",
+	} {
+		i := &MetaInfoV2{Path: p, Dir: path.Dir(p)}
+		if err := m.db().Create(i).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SetProgress(&WatchProgress{Path: "动画/第一季/e1.mp4", User: "u", Watched: true}); err != nil {
+		t.Fatal(err)
+	}
+	exts := []string{".mp4", ".mkv"}
+	cases := []struct {
+		prefix, user string
+		want         map[string]int
+	}{
+		{"动画", "u", map[string]int{"动画/第一季": 1, "动画/第二季": 2}},
+		{"/动画/", "other", map[string]int{"动画/第一季": 2, "动画/第二季": 2}},
+		{"动画/第二季", "u", map[string]int{"动画/第二季/sp": 1}},
+		{"", "u", map[string]int{"动画": 4, "动画x": 1, "show": 1}},
+	}
+	for _, c := range cases {
+		got, err := m.CountUnwatched(c.prefix, c.user, exts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("CountUnwatched(%q, %q) = %v, want %v", c.prefix, c.user, got, c.want)
+		}
+	}
+}
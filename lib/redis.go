@@ -1,22 +1,16 @@
 package lib
 
 import (
-	"bytes"
-	"flag"
 	"log"
 	"time"
 
-	"encoding/gob"
-
 	"github.com/gomodule/redigo/redis"
 )
 
 var Redis *RedisPool
-var redisHost string
 
-func init() {
-	flag.StringVar(&redisHost, "redis", "192.168.10.10", "redis host")
-}
+// RedisHost set before InitRedisPool
+var RedisHost string
 
 type RedisPool struct {
 	Pool redis.Pool
@@ -28,7 +22,7 @@ func InitRedisPool() {
 			MaxIdle:     6,
 			IdleTimeout: 240 * time.Second,
 			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", redisHost+":6379")
+				c, err := redis.Dial("tcp", RedisHost+":6379")
 				if err != nil {
 					return nil, err
 				}
@@ -69,31 +63,22 @@ func (r *RedisPool) Get(key string) ([]byte, bool) {
 		return nil, false
 	}
 }
-func (r *RedisPool) GetValue(key string, value interface{}) bool {
-	by, b := r.Get(key)
-	if !b {
-		return b
-	}
-	buf := bytes.NewBuffer(by)
 
-	err := gob.NewDecoder(buf).Decode(value)
-	if err != nil {
-		log.Println(err)
+func (r *RedisPool) Set(key string, value []byte, ttl time.Duration) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	var err error
+	if ttl > 0 {
+		_, err = conn.Do("SET", key, value, "PX", ttl.Milliseconds())
+	} else {
+		_, err = conn.Do("SET", key, value)
 	}
-	return true
+	return err
 }
 
-func (r *RedisPool) SetValueWithTTL(key string, value interface{}, second int) error {
+func (r *RedisPool) Del(key string) error {
 	conn := r.Pool.Get()
 	defer conn.Close()
-
-	var buf bytes.Buffer
-	gob.NewEncoder(&buf).Encode(value)
-
-	_, err := conn.Do("SET", key, buf.Bytes())
-	if err != nil {
-		return err
-	}
-	_, err = conn.Do("EXPIRE", key, second)
+	_, err := conn.Do("DEL", key)
 	return err
 }
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kiyor/k2fs/pkg/xnode"
@@ -17,8 +18,38 @@ type SearchClient struct {
 	*http.Client
 }
 
+const DefaultSearchProxy = "192.168.10.10:1080"
+
+var (
+	searchMu    sync.RWMutex
+	searchProxy = DefaultSearchProxy
+)
+
+// SetSearch set socks5 proxy and providers of search, empty proxy is direct
+func SetSearch(proxyAddr string, list []*SearchConfig) {
+	searchMu.Lock()
+	defer searchMu.Unlock()
+	searchProxy = proxyAddr
+	if list != nil {
+		SearchConfigList = list
+	}
+}
+
+func SearchConfigs() []*SearchConfig {
+	searchMu.RLock()
+	defer searchMu.RUnlock()
+	return SearchConfigList
+}
+
 func NewSearchClient() *SearchClient {
-	dialer, _ := proxy.SOCKS5("tcp", "192.168.10.10:1080", nil, proxy.Direct)
+	searchMu.RLock()
+	var dialer proxy.Dialer = proxy.Direct
+	if len(searchProxy) > 0 {
+		if d, err := proxy.SOCKS5("tcp", searchProxy, nil, proxy.Direct); err == nil {
+			dialer = d
+		}
+	}
+	searchMu.RUnlock()
 	transport := &http.Transport{
 		Dial:            dialer.Dial,
 		IdleConnTimeout: 30 * time.Second,
@@ -63,7 +94,7 @@ func (s *SearchClient) Search(name string) (*SearchResult, error) {
 	}
 	key := "SEARCH:" + name
 	var res SearchResult
-	if ok := Redis.GetValue(key, &res); ok {
+	if ok := KV.GetValue(key, &res); ok {
 		log.Println("SEARCH", name, "HIT")
 		return &res, nil
 	}
@@ -80,7 +111,7 @@ func (s *SearchClient) Search(name string) (*SearchResult, error) {
 	k := name
 
 	for _, name := range []string{name, strings.ToUpper(name), strings.ToLower(name)} {
-		for _, config := range SearchConfigList {
+		for _, config := range SearchConfigs() {
 			for i := 0; i < 2; i++ {
 				log.Println("REQUEST", config.Prefix+name)
 				req, err := http.NewRequest("GET", config.Prefix+name, nil)
@@ -125,7 +156,7 @@ func (s *SearchClient) Search(name string) (*SearchResult, error) {
 						res.Title = strings.TrimSpace(title)
 					}
 					// have value, cache 30 days
-					Redis.SetValueWithTTL(key, res, 2592000)
+					KV.SetValueWithTTL(key, res, 2592000)
 					return &res, nil
 				}
 				break
@@ -138,6 +169,6 @@ func (s *SearchClient) Search(name string) (*SearchResult, error) {
 		Title: "",
 	}
 	// not found, cache 10 days
-	Redis.SetValueWithTTL(key, res, 864000)
+	KV.SetValueWithTTL(key, res, 864000)
 	return nil, fmt.Errorf("not found")
 }
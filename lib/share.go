@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrShareRevoked  = errors.New("share revoked")
+	ErrShareExpired  = errors.New("share expired")
+	ErrShareExceeded = errors.New("share download limit exceeded")
+)
+
+// Share is a persistent share link of a file
+type Share struct {
+	ID           string     `json:"id" gorm:"primaryKey"`
+	Path         string     `json:"path" gorm:"index"`
+	CreatedBy    string     `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads int        `json:"max_downloads"` // 0 is unlimited
+	Downloads    int        `json:"downloads"`
+	PasswordHash string     `json:"-"`
+	HasPassword  bool       `json:"has_password" gorm:"-"`
+	Revoked      bool       `json:"revoked"`
+}
+
+func (s *Share) AfterFind(tx *gorm.DB) error {
+	s.HasPassword = len(s.PasswordHash) > 0
+	return nil
+}
+
+func (s *Share) SetPassword(password string) error {
+	if len(password) == 0 {
+		s.PasswordHash = ""
+		s.HasPassword = false
+		return nil
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.PasswordHash = string(b)
+	s.HasPassword = true
+	return nil
+}
+
+func (s *Share) CheckPassword(password string) bool {
+	if len(s.PasswordHash) == 0 {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// Valid return error if share can not be used anymore
+func (s *Share) Valid() error {
+	if s.Revoked {
+		return ErrShareRevoked
+	}
+	if s.ExpiresAt != nil && time.Now().After(*s.ExpiresAt) {
+		return ErrShareExpired
+	}
+	if s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads {
+		return ErrShareExceeded
+	}
+	return nil
+}
+
+func newShareID() (string, error) {
+	b := make([]byte, 10)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b)), nil
+}
+
+func (m *MetaV2) CreateShare(s *Share) error {
+	id, err := newShareID()
+	if err != nil {
+		return err
+	}
+	s.ID = id
+	s.Path = strings.TrimLeft(s.Path, "/")
+	s.CreatedAt = time.Now()
+	return m.db().Create(s).Error
+}
+
+func (m *MetaV2) GetShare(id string) (*Share, error) {
+	var s Share
+	res := m.db().Where("id = ?", id).First(&s)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return &s, nil
+}
+
+// ListShares list share of path, all share if path is empty
+func (m *MetaV2) ListShares(path string) ([]*Share, error) {
+	var list []*Share
+	session := m.db().Session(&gorm.Session{}).Order("created_at desc")
+	path = strings.TrimLeft(path, "/")
+	if len(path) > 0 {
+		session = session.Where("path = ?", path)
+	}
+	res := session.Find(&list)
+	return list, res.Error
+}
+
+func (m *MetaV2) RevokeShare(id string) error {
+	res := m.db().Model(&Share{}).Where("id = ?", id).Update("revoked", true)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// CountShareDownload increase download count, fail if limit already reached
+func (m *MetaV2) CountShareDownload(s *Share) error {
+	session := m.db().Model(&Share{}).Where("id = ?", s.ID)
+	if s.MaxDownloads > 0 {
+		session = session.Where("downloads < max_downloads")
+	}
+	res := session.Update("downloads", gorm.Expr("downloads + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrShareExceeded
+	}
+	s.Downloads++
+	return nil
+}
@@ -0,0 +1,117 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const TokenPrefix = "k2fs_"
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// token scope, perm of token user never higher than its scope
+var tokenScope = map[string]Perm{
+	"read":    PermRead,
+	"operate": PermDelete,
+	"admin":   PermAdmin,
+}
+
+// ScopePerm return max perm of scope, none if unknown
+func ScopePerm(scope string) Perm {
+	return tokenScope[scope]
+}
+
+// Token is personal api token of user, only sha256 of token stored
+type Token struct {
+	ID         string     `json:"id" gorm:"primaryKey"`
+	Name       string     `json:"name"`
+	User       string     `json:"user" gorm:"index"`
+	Scope      string     `json:"scope"`
+	Hash       string     `json:"-" gorm:"uniqueIndex"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Revoked    bool       `json:"revoked"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken save token and return plain token, which can not be shown again
+func (m *MetaV2) CreateToken(t *Token) (string, error) {
+	if ScopePerm(t.Scope) == PermNone {
+		return "", errors.New("unknown scope " + t.Scope)
+	}
+	b := make([]byte, 28)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	plain := TokenPrefix + hex.EncodeToString(b[:24])
+	t.ID = hex.EncodeToString(b[24:])
+	t.Hash = hashToken(plain)
+	t.CreatedAt = time.Now()
+	return plain, m.db().Create(t).Error
+}
+
+// GetTokenUser return user and token of plain token, record last use
+func (m *MetaV2) GetTokenUser(plain string) (*User, *Token, error) {
+	var t Token
+	res := m.db().Where("hash = ?", hashToken(strings.TrimSpace(plain))).First(&t)
+	if res.Error != nil {
+		return nil, nil, res.Error
+	}
+	if t.Revoked {
+		return nil, nil, ErrTokenRevoked
+	}
+	u, err := m.GetUser(t.User)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	// not write db on every request
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > time.Minute {
+		t.LastUsedAt = &now
+		m.db().Model(&t).Update("last_used_at", now)
+	}
+	u.Scope = ScopePerm(t.Scope)
+	return u, &t, nil
+}
+
+// ListTokens list token of user, all token if user is empty
+func (m *MetaV2) ListTokens(user string) ([]*Token, error) {
+	var list []*Token
+	session := m.db().Session(&gorm.Session{}).Order("created_at desc")
+	if len(user) > 0 {
+		session = session.Where("user = ?", user)
+	}
+	res := session.Find(&list)
+	return list, res.Error
+}
+
+func (m *MetaV2) GetToken(id string) (*Token, error) {
+	var t Token
+	res := m.db().Where("id = ?", id).First(&t)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return &t, nil
+}
+
+func (m *MetaV2) RevokeToken(id string) error {
+	res := m.db().Model(&Token{}).Where("id = ?", id).Update("revoked", true)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
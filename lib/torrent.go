@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"time"
+)
+
+// TorrentJob is torrent added by k2fs, keep which dir it download to
+type TorrentJob struct {
+	Hash      string    `json:"hash" gorm:"primaryKey"` // info hash in lower hex
+	Client    string    `json:"client"`
+	Name      string    `json:"name"`
+	Dir       string    `json:"dir"`    // save path relative to root
+	Source    string    `json:"source"` // upload, magnet or watch
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *MetaV2) SaveTorrentJob(j *TorrentJob) error {
+	return m.db().Save(j).Error
+}
+
+// ListTorrentJobs return all job by hash
+func (m *MetaV2) ListTorrentJobs() (map[string]*TorrentJob, error) {
+	var list []*TorrentJob
+	res := m.db().Find(&list)
+	out := make(map[string]*TorrentJob)
+	for _, j := range list {
+		out[j.Hash] = j
+	}
+	return out, res.Error
+}
+
+func (m *MetaV2) DelTorrentJob(hash string) error {
+	return m.db().Where("hash = ?", hash).Delete(&TorrentJob{}).Error
+}
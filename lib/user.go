@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user" // same as delete
+
+	// DigestRealm realm of http digest auth, part of stored ha1
+	DigestRealm = "k2fs"
+)
+
+// Perm is permission level, higher level include lower one
+type Perm int
+
+const (
+	PermNone Perm = iota
+	PermRead
+	PermWrite
+	PermDelete
+	PermAdmin
+)
+
+var permName = map[Perm]string{
+	PermNone:   "none",
+	PermRead:   "read",
+	PermWrite:  "write",
+	PermDelete: "delete",
+	PermAdmin:  "admin",
+}
+
+func (p Perm) String() string {
+	return permName[p]
+}
+
+// ParsePerm parse role or perm name, unknown name is none
+func ParsePerm(s string) Perm {
+	if s == RoleUser {
+		return PermDelete
+	}
+	for k, v := range permName {
+		if v == s {
+			return k
+		}
+	}
+	return PermNone
+}
+
+// Grant is perm of user under path prefix
+type Grant struct {
+	Prefix string `json:"prefix"`
+	Perm   string `json:"perm"`
+}
+
+// User is an account able to login
+type User struct {
+	Name         string         `json:"name" gorm:"primaryKey"`
+	PasswordHash string         `json:"-"`
+	DigestHA1    string         `json:"-"`
+	Root         string         `json:"root"` // webdav root relative to root dir, empty is whole root
+	Role         string         `json:"role"` // default perm: read, write, delete(user) or admin
+	Grants       datatypes.JSON `json:"grants"`
+	CreatedAt    time.Time      `json:"created_at"`
+	LastLogin    *time.Time     `json:"last_login"`
+	Scope        Perm           `json:"-" gorm:"-"` // max perm of request, set by api token
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin && (u.Scope == PermNone || u.Scope >= PermAdmin)
+}
+
+// CredVersion change when password, role or grants changed, session
+// login with older version is no longer valid
+func (u *User) CredVersion() string {
+	sum := sha256.Sum256([]byte(u.PasswordHash + ":" + u.Role + ":" + string(u.Grants)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (u *User) GetGrants() []Grant {
+	var grants []Grant
+	if len(u.Grants) > 0 {
+		json.Unmarshal(u.Grants, &grants)
+	}
+	return grants
+}
+
+func (u *User) SetGrants(grants []Grant) error {
+	for k, g := range grants {
+		grants[k].Prefix = strings.Trim(g.Prefix, "/")
+		if g.Perm != PermNone.String() && ParsePerm(g.Perm) == PermNone {
+			return errors.New("unknown perm " + g.Perm)
+		}
+	}
+	b, err := json.Marshal(grants)
+	if err != nil {
+		return err
+	}
+	u.Grants = datatypes.JSON(b)
+	return nil
+}
+
+// Perm return perm of path relative to root, the longest matched grant win,
+// role is the perm if no grant match, never higher than scope of token
+func (u *User) Perm(path string) Perm {
+	perm := u.perm(path)
+	if u.Scope > PermNone && perm > u.Scope {
+		return u.Scope
+	}
+	return perm
+}
+
+func (u *User) perm(path string) Perm {
+	if u.Role == RoleAdmin {
+		return PermAdmin
+	}
+	path = strings.Trim(path, "/")
+	perm := ParsePerm(u.Role)
+	matched := -1
+	for _, g := range u.GetGrants() {
+		if len(g.Prefix) <= matched {
+			continue
+		}
+		if len(g.Prefix) == 0 || path == g.Prefix || strings.HasPrefix(path, g.Prefix+"/") {
+			matched = len(g.Prefix)
+			perm = ParsePerm(g.Perm)
+		}
+	}
+	return perm
+}
+
+func (u *User) Allowed(path string, perm Perm) bool {
+	return u.Perm(path) >= perm
+}
+
+// AllowedTree report true if path and everything under it has perm
+func (u *User) AllowedTree(path string, perm Perm) bool {
+	if !u.Allowed(path, perm) {
+		return false
+	}
+	path = strings.Trim(path, "/")
+	for _, g := range u.GetGrants() {
+		if len(g.Prefix) > 0 && (len(path) == 0 || strings.HasPrefix(g.Prefix, path+"/")) && !u.Allowed(g.Prefix, perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// Visible report true if path or anything under it is readable,
+// parent of a readable grant need to be listed
+func (u *User) Visible(path string) bool {
+	if u.Allowed(path, PermRead) {
+		return true
+	}
+	path = strings.Trim(path, "/")
+	for _, g := range u.GetGrants() {
+		if ParsePerm(g.Perm) >= PermRead && (len(path) == 0 || strings.HasPrefix(g.Prefix, path+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) SetPassword(password string) error {
+	if len(password) < 6 {
+		return errors.New("password too short")
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(b)
+	sum := md5.Sum([]byte(u.Name + ":" + DigestRealm + ":" + password))
+	u.DigestHA1 = hex.EncodeToString(sum[:])
+	return nil
+}
+
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+func (m *MetaV2) GetUser(name string) (*User, error) {
+	var u User
+	res := m.db().Where("name = ?", name).First(&u)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return &u, nil
+}
+
+func (m *MetaV2) CreateUser(u *User) error {
+	u.Name = strings.TrimSpace(u.Name)
+	if len(u.Name) == 0 {
+		return errors.New("empty user name")
+	}
+	if len(u.Role) == 0 {
+		u.Role = RoleUser
+	}
+	u.CreatedAt = time.Now()
+	return m.db().Create(u).Error
+}
+
+func (m *MetaV2) SaveUser(u *User) error {
+	return m.db().Save(u).Error
+}
+
+// DeleteUser delete user and revoke its token
+func (m *MetaV2) DeleteUser(name string) error {
+	return m.db().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("name = ?", name).Delete(&User{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Token{}).Where("user = ?", name).Update("revoked", true).Error
+	})
+}
+
+func (m *MetaV2) ListUsers() ([]*User, error) {
+	var list []*User
+	res := m.db().Order("name").Find(&list)
+	return list, res.Error
+}
+
+func (m *MetaV2) CountUsers() (int64, error) {
+	var count int64
+	res := m.db().Model(&User{}).Count(&count)
+	return count, res.Error
+}
+
+// Login check user password and record login time
+func (m *MetaV2) Login(name, password string) (*User, error) {
+	u, err := m.GetUser(name)
+	if err != nil || !u.CheckPassword(password) {
+		return nil, errors.New("invalid user or password")
+	}
+	now := time.Now()
+	u.LastLogin = &now
+	m.db().Model(u).Update("last_login", now)
+	return u, nil
+}
@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// DeadLetter is event failed to deliver to webhook after all retry
+type DeadLetter struct {
+	ID        uint           `json:"id" gorm:"primaryKey"`
+	Webhook   string         `json:"webhook"`
+	EventType string         `json:"event_type"`
+	Event     datatypes.JSON `json:"event"`
+	Attempts  int            `json:"attempts"`
+	Error     string         `json:"error"`
+	CreatedAt time.Time      `json:"created_at" gorm:"index"`
+}
+
+func (m *MetaV2) SaveDeadLetter(d *DeadLetter) error {
+	return m.db().Create(d).Error
+}
+
+// ListDeadLetters return latest dead letter first
+func (m *MetaV2) ListDeadLetters(limit int) ([]*DeadLetter, error) {
+	var list []*DeadLetter
+	res := m.db().Order("id desc").Limit(limit).Find(&list)
+	return list, res.Error
+}
+
+func (m *MetaV2) GetDeadLetter(id uint) (*DeadLetter, error) {
+	var d DeadLetter
+	res := m.db().Where("id = ?", id).First(&d)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	return &d, nil
+}
+
+func (m *MetaV2) DelDeadLetter(id uint) error {
+	return m.db().Where("id = ?", id).Delete(&DeadLetter{}).Error
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kiyor/golib"
+)
+
+var (
+	// appCtx done when shutdown start, background loop and queued task stop
+	appCtx, appStop = context.WithCancel(context.Background())
+	// async file move and scan started by request, waited before database closed
+	asyncOps group
+	// background loop of every, waited before database closed
+	loops sync.WaitGroup
+	// webhook delivery, waited after operation and loop so their event is
+	// still sent, deliverCtx cancel post in flight at shutdown deadline
+	deliveries              group
+	deliverCtx, deliverStop = context.WithCancel(context.Background())
+)
+
+// every run f at once and then every d until shutdown
+func every(d time.Duration, f func()) {
+	everyAfter(0, d, f)
+}
+
+// everyAfter run f after delay and then every d until shutdown, call it
+// before serve so loops is not added while waited
+func everyAfter(delay, d time.Duration, f func()) {
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		select {
+		case <-appCtx.Done():
+			return
+		case <-time.After(delay):
+		}
+		for {
+			f()
+			select {
+			case <-appCtx.Done():
+				return
+			case <-time.After(d):
+			}
+		}
+	}()
+}
+
+// group is WaitGroup refuse new task once closed, so add never race with wait
+type group struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Go run f in background, false if group closed
+func (g *group) Go(f func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Close refuse new task and wait running task for d, false if timeout
+func (g *group) Close(d time.Duration) bool {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	return waitTimeout(&g.wg, d)
+}
+
+// submit queue task to manager, drop it if shutting down
+func submit(tasks chan golib.Task, t golib.Task) {
+	select {
+	case tasks <- t:
+	case <-appCtx.Done():
+	}
+}
+
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// serve run server and redirect server if not nil until SIGINT or SIGTERM,
+// then stop accepting request, wait for running request and operation and
+// close database
+func serve(srv *http.Server, listen func() error, redirect *http.Server) {
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- listen()
+	}()
+	if redirect != nil {
+		log.Println("redirect http", redirect.Addr, "to https")
+		go func() {
+			errCh <- redirect.ListenAndServe()
+		}()
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errCh:
+		log.Fatal(err)
+	case s := <-sig:
+		log.Println("receive", s, "shutdown")
+	}
+	appStop()
+	deadline := time.Now().Add(flagShutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("shutdown", err)
+	}
+	if redirect != nil {
+		if err := redirect.Shutdown(ctx); err != nil {
+			log.Println("shutdown redirect", err)
+		}
+	}
+	hls.StopAll()
+	// no new operation after this
+	opMutex.Lock()
+	if !asyncOps.Close(time.Until(deadline)) {
+		log.Println("shutdown timeout, file operation still running")
+	}
+	if !waitTimeout(&loops, time.Until(deadline)) {
+		log.Println("shutdown timeout, background loop still running")
+	}
+	if !deliveries.Close(time.Until(deadline)) {
+		log.Println("shutdown timeout, cancel webhook delivery")
+		deliverStop()
+		// cancelled delivery save dead letter before database closed
+		waitTimeout(&deliveries.wg, time.Second)
+	}
+	if err := metaV2.Close(); err != nil {
+		log.Println(err)
+	}
+	log.Println("shutdown done")
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/base64"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
@@ -21,7 +19,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -49,25 +46,32 @@ var hideContain = []string{
 	"padding_file",
 	".DS_Store",
 	".kfs.db",
+	".kfs_session.key",
+	".kfs_ca.",
+	".kfs_tls.",
 }
 var hideRe = []*regexp.Regexp{
 	regexp.MustCompile(`^\.nfs[\w]{24}`),
 	regexp.MustCompile(`996gg\.cc`),
 }
 var videoExt = map[string]string{
-	".mp4": "video/mp4",
-	".mov": "video/quicktime",
-	".avi": "",
-	".wmv": "",
-	".mkv": "video/mp4",
-	".ts":  "video/MP2T",
-	".flv": "",
-	".mpg": "",
-	".dat": "",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".avi":  "",
+	".wmv":  "",
+	".mkv":  "video/mp4",
+	".ts":   "video/MP2T",
+	".flv":  "",
+	".mpg":  "",
+	".dat":  "",
 }
 
 func isVideo(file string) bool {
 	ext := strings.ToLower(filepath.Ext(file))
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
 	for v := range videoExt {
 		if v == ext {
 			return true
@@ -75,8 +79,20 @@ func isVideo(file string) bool {
 	}
 	return false
 }
+func videoExts() []string {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	var exts []string
+	for v := range videoExt {
+		exts = append(exts, v)
+	}
+	return exts
+}
+
 func videoType(file string) string {
 	ext := strings.ToLower(filepath.Ext(file))
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
 	if v, ok := videoExt[ext]; ok {
 		return v
 	}
@@ -129,6 +145,19 @@ func isIos(r *http.Request) bool {
 }
 
 func needHide(path string) bool {
+	if isPrivate(path) || filepath.Base(path) == kfs.KFS || hideByRule(path) {
+		return true
+	}
+	if isSubtitleSidecar(path) {
+		return true
+	}
+	return false
+}
+
+// hideByRule match hide rule of config
+func hideByRule(path string) bool {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
 	for _, v := range hideExt {
 		if strings.ToUpper(filepath.Ext(path)) == v {
 			return true
@@ -158,8 +187,9 @@ type Thumb struct {
 	Height int
 }
 
+// buildCacheKey include user, result is filtered by perm of user
 func buildCacheKey(r *http.Request, i interface{}) string {
-	return r.URL.Path + toJSON(r.URL.Query()) + toJSON(i)
+	return currentUser(r) + ":" + r.URL.Path + toJSON(r.URL.Query()) + toJSON(i)
 }
 
 func apiThumb(w http.ResponseWriter, r *http.Request) {
@@ -171,22 +201,31 @@ func apiThumb(w http.ResponseWriter, r *http.Request) {
 		NewErrResp(w, 1, err)
 		return
 	}
-	cacheKey := buildCacheKey(r, m)
-	if val, err := lib.Cache.Get(cacheKey); err == nil {
-		w.Header().Add("content-type", "application/json")
-		w.Write(val.([]byte))
-		return
-	}
-
 	path := m["path"]
 	if strings.Contains(path, "%") {
 		path, _ = url.PathUnescape(path)
 	}
-	path = strings.TrimRight(path, "/")
-	if len(path) == 0 {
-		path = "/"
+	rel, abs, err := resolvePath(path)
+	if err != nil {
+		forbidden(w, r)
+		return
+	}
+	path = "/" + rel
+	if !allowed(r, path, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	cacheKey := buildCacheKey(r, m)
+	if b, ok := lib.ThumbCache.Get(cacheKey); ok {
+		w.Header().Add("content-type", "application/json")
+		w.Write(b)
+		return
 	}
-	abs := filepath.Join(rootDir, path)
+	release, ok := rateLimit(w, r, "thumb")
+	if !ok {
+		return
+	}
+	defer release()
 
 	f, err := os.Stat(abs)
 	if err != nil {
@@ -226,21 +265,21 @@ func apiThumb(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if f.IsDir() {
-		fs := readDir2(abs)
+		fs := filterReadable(r, readDir2(abs))
 		if len(fs) == 0 {
-			NewCacheResp(w, "", cacheKey, time.Hour)
+			NewCacheResp(w, "", lib.ThumbCache, cacheKey, rel)
 			// 			log.Println("MISS", cacheKey)
 			return
 		}
 		for _, v := range fs {
 			if strings.HasSuffix(strings.ToLower(v), "cover.") {
-				NewCacheResp(w, fp(v), cacheKey, time.Hour)
+				NewCacheResp(w, fp(v), lib.ThumbCache, cacheKey, rel)
 				// 				log.Println("MISS", cacheKey)
 				return
 			}
 		}
 		sort.Strings(fs)
-		NewCacheResp(w, fp(fs[0]), cacheKey, time.Hour)
+		NewCacheResp(w, fp(fs[0]), lib.ThumbCache, cacheKey, rel)
 		// 		log.Println("MISS", cacheKey)
 		return
 	}
@@ -288,14 +327,19 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 	if strings.Contains(path, "%") {
 		path, _ = url.PathUnescape(path)
 	}
-	path = strings.TrimRight(path, "/")
-	if len(path) == 0 {
-		path = "/"
+	rel, abs, err := resolvePath(path)
+	if err != nil {
+		forbidden(w, r)
+		return
 	}
+	path = "/" + rel
 	if _, ok := args["listdir"]; !ok {
 		args["listdir"] = "read"
 	}
-	abs := filepath.Join(rootDir, path)
+	if !visible(r, path) {
+		forbidden(w, r)
+		return
+	}
 	f, err := os.Stat(abs)
 	if err != nil {
 		NewErrResp(w, 1, err)
@@ -336,6 +380,15 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 			log.Printf("limit %T %v", val, val)
 		}
 	}
+	var unwatched bool
+	if args["unwatched"] != nil {
+		switch val := args["unwatched"].(type) {
+		case bool:
+			unwatched = val
+		case string:
+			unwatched, _ = strconv.ParseBool(val)
+		}
+	}
 	var page int
 	if args["page"] != nil {
 		switch val := args["page"].(type) {
@@ -361,7 +414,12 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 			fs, err = ioReadDir(abs)
 		}
 		if isFind {
+			release, ok := rateLimit(w, r, "search")
+			if !ok {
+				return
+			}
 			fs, err = filePathWalkDir(abs, isSearch)
+			release()
 		}
 		if err != nil {
 			log.Println(err)
@@ -378,15 +436,6 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 		dir.Dir = path
 		dir.Hash = hash(path)
 		dir.UpDir = upDir(dir.Dir)
-		/*
-				if isRead {
-					for _, f := range list {
-						// dirSize(filepath.Join(abs, f.Name()))
-						dirSize2(filepath.Join(path, f.Name()))
-					}
-				}
-			 remove for test
-		*/
 		// time.Sleep(200 * time.Millisecond)
 
 		//TODO optimize search/filter, do before some action like size()
@@ -395,19 +444,16 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 		meta = kfs.NewMeta(kp)
 		replacer := strings.NewReplacer("+", "%20", "#", "%23")
 		for p, f := range list {
+			if !visible(r, p) {
+				continue
+			}
 			nf := NewFile(f.Name())
 			nf.Hash = hash(filepath.Join(abs, f.Name()))
 			pathID := filepath.Join(path, f.Name())
-			if isRead {
-				// fullPath := filepath.Join(abs, f.Name())
-				// nf.Size, err = dirSize(fullPath)
-				nf.Size, err = dirSize2(pathID)
-				if err != nil {
-					log.Println(err)
-				}
-			}
-			if isFind {
-				nf.Size = f.Size()
+			nf.Size, nf.SizeState = f.Size(), lib.SizeExact
+			// walk of index not follow symlink, dir behind it has no size
+			if isRead && f.IsDir() && !isSymlink(filepath.Join(abs, f.Name())) {
+				nf.Size, nf.SizeState = dirSize(pathID, f.ModTime())
 			}
 			nf.Path = p
 			nf.SizeH = humanize.IBytes(uint64(nf.Size))
@@ -423,32 +469,25 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 				nf.Meta = m
 			}
 			fp := filepath.Join("/statics", p)
-			host := "http://" + r.Host
-			if len(flagHost) > 0 {
-				host = flagHost
-			}
-			b64md5fp := enc(fp)
+			host := reqHost(r)
 			if isVideo(nf.Name) {
-				qv := url.Values{}
-				qv["url"] = []string{host + "/s/" + b64md5fp}
-				t := videoType(nf.Name)
-				if len(t) > 0 {
-					qv["type"] = []string{t}
-				}
-				q := replacer.Replace(qv.Encode())
+				q := videoQuery(r, host, p)
+				nf.PlayList = playlistLink(r, openWith, host, p)
+				// external player has no session cookie, link is signed
+				link := signLink(r, host+replacer.Replace(fp), fp, nil)
 				switch openWith {
 				case "iina":
 					nf.ShortCut = "iina://open?" + q
 				case "nplayer":
-					nf.ShortCut = "nplayer-" + host + replacer.Replace(fp) //nplayer
+					nf.ShortCut = "nplayer-" + link //nplayer
 				case "vlc":
-					nf.ShortCut = "vlc://" + host + replacer.Replace(fp) //vlc
+					nf.ShortCut = "vlc://" + link //vlc
 				case "potplayer":
-					nf.ShortCut = "potplayer://" + host + replacer.Replace(fp) //potplayer
+					nf.ShortCut = "potplayer://" + link //potplayer
 				case "mxplayer":
-					nf.ShortCut = "intent:" + host + replacer.Replace(fp) //mxplayer
+					nf.ShortCut = "intent:" + link //mxplayer
 				case "native":
-					nf.ShortCut = host + replacer.Replace(fp)
+					nf.ShortCut = link
 				case "browser":
 					nf.ShortCut = "/player?" + q
 				default:
@@ -459,6 +498,12 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 			}
 			dir.Files = append(dir.Files, nf)
 		}
+		fillProgress(dir.Files, path, currentUser(r))
+		fillIntegrity(dir.Files, path)
+		fillTorrent(dir.Files)
+		if unwatched {
+			dir.Files = onlyUnwatched(dir.Files)
+		}
 		desc := true
 		if args["desc"] != nil && args["desc"].(string) != "" {
 			session.Values["desc"] = []string{args["desc"].(string)}
@@ -556,7 +601,7 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 						key += ":cdn"
 					}
 					var jr JavResp
-					if b := lib.Redis.GetValue(key, &jr); b {
+					if b := lib.KV.GetValue(key, &jr); b {
 						if jr.Data.UserData.Like {
 							v.Description += `♥️`
 						}
@@ -625,7 +670,7 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 						if jr.Data.ID > 0 {
 							ttl = 2592000 // if found, cache for 30 days
 						}
-						lib.Redis.SetValueWithTTL(key, jr, ttl)
+						lib.KV.SetValueWithTTL(key, jr, ttl)
 						if jr.Data.UserData.Like {
 							v.Description += `♥️`
 						}
@@ -680,9 +725,8 @@ func apiList(w http.ResponseWriter, r *http.Request) {
 				}
 				t2 := time.Now()
 				if _, b := isSearchable(name); !found && b {
-					key := "title:" + pathID
-					if val, err := lib.Cache.Get(key); err == nil {
-						v.Description = `❗` + val.(string)
+					if title, ok := lib.TitleCache.Get(pathID); ok {
+						v.Description = `❗` + title
 					} else {
 						fetchTitle(pathID)
 					}
@@ -861,6 +905,8 @@ func isAV(name string) (string, bool) {
 		name = reIBW.ReplaceAllString(name, "$1")
 		return name, true
 	}
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
 	for _, re := range reAV {
 		if re.MatchString(name) {
 			return name, true
@@ -897,6 +943,23 @@ func ioReadDir(root string) ([]string, error) {
 	return files, nil
 }
 
+// videoQuery return query of video for built-in player and iina, p is relative to rootDir
+func videoQuery(r *http.Request, host, p string) string {
+	replacer := strings.NewReplacer("+", "%20", "#", "%23")
+	fp := filepath.Join("/statics", p)
+	qv := url.Values{}
+	qv["url"] = []string{signLink(r, host+(&url.URL{Path: fp}).String(), fp, nil)}
+	qv["path"] = []string{"/" + p}
+	if l := hlsLink(p); len(l) > 0 {
+		qv["hls"] = []string{l}
+	}
+	t := videoType(p)
+	if len(t) > 0 {
+		qv["type"] = []string{t}
+	}
+	return replacer.Replace(qv.Encode())
+}
+
 func slice2fileinfo(s []string, prefix string) (map[string]os.FileInfo, error) {
 	fs := make(map[string]os.FileInfo)
 	l := len(filepath.Join(rootDir)) //, prefix))
@@ -917,28 +980,6 @@ func slice2fileinfo(s []string, prefix string) (map[string]os.FileInfo, error) {
 	return fs, nil
 }
 
-var shortUrl = make(map[string]string)
-var shortMu = sync.Mutex{}
-
-func enc(s string) string {
-	v := md5Encode(base64Encode(s))
-	shortMu.Lock()
-	shortUrl[v] = s
-	shortMu.Unlock()
-	// log.Println(v, s)
-	return v
-}
-
-func base64Encode(s string) string {
-	v := base64.StdEncoding.EncodeToString([]byte(s))
-	return v
-}
-
-func md5Encode(s string) string {
-	v := fmt.Sprintf("%x", md5.Sum([]byte(s)))
-	return v
-}
-
 func runWithTimeout(fc func() error, timeout time.Duration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"io"
 	"log"
@@ -22,13 +21,14 @@ func NewLogHandler() *LogHandler {
 	}
 }
 
+var redactQuery = []string{"password", "sig", "token"}
+
 type statusWriter struct {
 	http.ResponseWriter
 	http.Flusher
 	http.Hijacker
 	status int
 	length int
-	body   []byte
 }
 
 func (w *statusWriter) WriteHeader(status int) {
@@ -41,8 +41,6 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 		w.status = 200
 	}
 	w.length += len(b)
-	w.body = append(w.body, b...)
-
 	return w.ResponseWriter.Write(b)
 }
 
@@ -53,22 +51,22 @@ func (l *LogHandler) Set(out io.Writer, prefix string, flag int) {
 func (l *LogHandler) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t1 := time.Now()
-		ctx := context.Background()
 
-		writer := statusWriter{
-			w,
-			w.(http.Flusher),
-			w.(http.Hijacker),
-			0,
-			0,
-			nil,
-		}
-		r = r.WithContext(ctx)
+		writer := statusWriter{ResponseWriter: w}
+		// http2 response writer is not a hijacker
+		writer.Flusher, _ = w.(http.Flusher)
+		writer.Hijacker, _ = w.(http.Hijacker)
 		next.ServeHTTP(&writer, r)
 
 		reqURI := r.URL.Path
-		if len(r.URL.Query()) > 0 {
-			reqURI += "?" + r.URL.Query().Encode()
+		if q := r.URL.Query(); len(q) > 0 {
+			// credential in query should not be in log
+			for _, k := range redactQuery {
+				if q.Has(k) {
+					q.Set(k, "xxx")
+				}
+			}
+			reqURI += "?" + q.Encode()
 		}
 		ua := r.Header.Get("User-Agent")
 		res := fmt.Sprintf("%v %v %v %v %v %v '%v'", r.RemoteAddr, writer.status, writer.length, r.Method, reqURI, time.Since(t1), ua)
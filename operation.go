@@ -38,8 +38,6 @@ var Trash string
 var opMutex *sync.Mutex = new(sync.Mutex)
 
 func apiOperation(w http.ResponseWriter, r *http.Request) {
-	opMutex.Lock()
-	defer opMutex.Unlock()
 	defer r.Body.Close()
 	var op Operation
 	err := json.NewDecoder(r.Body).Decode(&op)
@@ -47,10 +45,33 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 		NewErrResp(w, 1, err)
 		return
 	}
+	if op.Action == "unzip" {
+		release, ok := rateLimit(w, r, "unzip")
+		if !ok {
+			return
+		}
+		defer release()
+	}
+	opMutex.Lock()
+	defer opMutex.Unlock()
 
 	// log.Println(toJSON(op))
 
-	path := filepath.Join(rootDir, op.Dir)
+	dir, path, err := resolvePath(op.Dir)
+	if err != nil {
+		forbidden(w, r)
+		return
+	}
+	op.Dir = dir
+	perm := operationPerm(op.Action)
+	for k := range op.Files {
+		// file must be direct child of dir
+		rel, _, err := resolvePath(filepath.Join(op.Dir, k))
+		if err != nil || filepath.Dir(rel) != filepath.Join(".", op.Dir) || !allowed(r, rel, perm) {
+			forbidden(w, r)
+			return
+		}
+	}
 
 	meta := kfs.NewMeta(path)
 	for k, b := range op.Files {
@@ -75,9 +96,12 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 				d := filepath.Dir(file)
 				f := filepath.Base(file)
 				b := filepath.Join(d, f[:len(f)-4])
+				e := newAudit(r, "api", "unzip", key)
+				e.Dst = filepath.Join(op.Dir, f[:len(f)-4])
 				err := os.Mkdir(b, 0755)
 				if err != nil {
 					log.Println(err)
+					audit(e, err)
 					return
 				}
 				switch filepath.Ext(strings.ToLower(file)) {
@@ -92,7 +116,8 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 				log.Println(d, cmd)
 				c.Stderr = os.Stderr
 				c.Stdout = os.Stdout
-				c.Run()
+				audit(e, c.Run())
+				lib.InvalidatePath(e.Dst)
 			case strings.HasPrefix(op.Action, "label"):
 				to := strings.Split(op.Action, "=")
 				if len(to) > 1 {
@@ -102,6 +127,7 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 				}
 				meta.Set(k, m)
 				m2.SetLabel(m.Label)
+				emit(r, "label.changed", key, map[string]string{"label": m.Label})
 			case strings.HasPrefix(op.Action, "mark"):
 				switch op.ActionValue() {
 				case "5":
@@ -110,10 +136,12 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 					m.Label = "danger"
 					m.Star = true
 					meta.Set(k, m)
+					emit(r, "label.changed", key, map[string]string{"label": m.Label})
 				case "4":
 					m2.SetLabel("danger")
 					m.Label = "danger"
 					meta.Set(k, m)
+					emit(r, "label.changed", key, map[string]string{"label": m.Label})
 				default:
 				}
 			case strings.HasPrefix(op.Action, "icons"):
@@ -142,46 +170,69 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 				if strings.HasPrefix(file, Trash) {
 					dst := filepath.Join(m.OldLoc)
 					log.Println("mv", file, dst)
-					os.Rename(file, dst)
+					e := newAudit(r, "api", "restore", key)
+					e.Dst, _ = filepath.Rel(rootDir, dst)
+					err := os.Rename(file, dst)
+					audit(e, err)
+					if err == nil {
+						auditEvent("file.restored", e)
+					}
 					dstMeta := kfs.NewMeta(filepath.Dir(dst))
 					dstMeta.Set(k, m)
 					dstMeta.Write()
 					meta.Del(k)
-					lib.Cache.Remove("size:.Trash")
+					lib.InvalidatePath(key, e.Dst)
 				}
 			case op.Action == "delete":
 				log.Println(file, Trash)
-				trashMeta := kfs.NewMeta(Trash)
 				// delete trash, delete all file in trash
 				if file == Trash {
-					fs, _ := os.ReadDir(Trash)
-					for _, v := range fs {
-						f := filepath.Join(Trash, v.Name())
-						err := os.RemoveAll(f)
-						log.Println("rm -rf", f, err)
-					}
+					purgeTrash(func(path string) *lib.AuditEntry {
+						return newAudit(r, "api", "purge", path)
+					})
 				} else if strings.HasPrefix(file, Trash) { // file inside trash, delete single file
 					err := os.RemoveAll(file)
 					log.Println("rm -rf", file, err)
+					e := newAudit(r, "api", "purge", key)
+					audit(e, err)
+					if err == nil {
+						auditEvent("file.purged", e)
+					}
 					meta.Del(k)
 					// 					trashMeta.Write()
 				} else { // not inside trash
-					dst := filepath.Join(Trash, k)
-					log.Println("mv", file, dst)
-					go os.Rename(file, dst)
-					meta.Del(k)
-					m.OldLoc = file
-					trashMeta.Set(k, m)
-					err := trashMeta.Write()
-					if err != nil {
-						log.Println(err)
-					}
-					metaV2.MoveDir(key, ".Trash")
+					moveToTrash(newAudit(r, "api", "delete", key), meta, k, key, file, m)
 				}
-				lib.Cache.Remove("size:.Trash")
+				lib.InvalidatePath(key, ".Trash")
 				metaV2.RemoveOrphan(".Trash")
 				metaV2.Index(".Trash")
-				dirSize2(".Trash")
+			case op.ActionKey() == "torrent":
+				e := newAudit(r, "api", "torrent_"+op.ActionValue(), key)
+				err := torrentAction(key, op.ActionValue())
+				audit(e, err)
+				if err == nil && op.ActionValue() == "delete" && !strings.HasPrefix(file, Trash) {
+					moveToTrash(newAudit(r, "api", "delete", key), meta, k, key, file, m)
+					lib.InvalidatePath(key, ".Trash")
+				}
+			case op.ActionKey() == "dedupe":
+				keep := dupeToKeep(key, &op)
+				if len(keep) == 0 || strings.HasPrefix(file, Trash) {
+					log.Println(key, "no duplicate to keep")
+					continue
+				}
+				if op.ActionValue() == "link" {
+					e := newAudit(r, "api", "dedupe_link", key)
+					e.Dst = keep
+					err := hardlink(filepath.Join(rootDir, keep), file)
+					audit(e, err)
+					if err == nil {
+						metaV2.CopyHash(key, keep)
+					}
+					lib.InvalidatePath(key)
+				} else {
+					moveToTrash(newAudit(r, "api", "dedupe_trash", key), meta, k, key, file, m)
+					lib.InvalidatePath(key, ".Trash")
+				}
 			}
 		}
 	}
@@ -193,3 +244,43 @@ func apiOperation(w http.ResponseWriter, r *http.Request) {
 	}
 	NewResp(w, "success", nil)
 }
+
+// purgeTrash delete everything in trash, opMutex must be held
+func purgeTrash(newEntry func(path string) *lib.AuditEntry) {
+	fs, _ := os.ReadDir(Trash)
+	for _, v := range fs {
+		f := filepath.Join(Trash, v.Name())
+		err := os.RemoveAll(f)
+		log.Println("rm -rf", f, err)
+		e := newEntry(filepath.Join(".Trash", v.Name()))
+		audit(e, err)
+		if err == nil {
+			auditEvent("file.purged", e)
+		}
+	}
+}
+
+// moveToTrash move file to trash in background, meta of file move with it
+func moveToTrash(e *lib.AuditEntry, meta *kfs.Meta, k, key, file string, m kfs.MetaInfo) {
+	dst := filepath.Join(Trash, k)
+	log.Println("mv", file, dst)
+	e.Dst = filepath.Join(".Trash", k)
+	move := func() {
+		err := os.Rename(file, dst)
+		audit(e, err)
+		if err == nil {
+			auditEvent("file.trashed", e)
+		}
+	}
+	if !asyncOps.Go(move) {
+		move()
+	}
+	meta.Del(k)
+	m.OldLoc = file
+	trashMeta := kfs.NewMeta(Trash)
+	trashMeta.Set(k, m)
+	if err := trashMeta.Write(); err != nil {
+		log.Println(err)
+	}
+	metaV2.MoveDir(key, ".Trash")
+}
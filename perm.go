@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// file under root never served, db and secret of k2fs itself
+var privateFile = []string{
+	".kfs.db",
+	".kfs_session.key",
+	".kfs_ca.",
+	".kfs_tls.",
+}
+
+func isPrivate(path string) bool {
+	base := filepath.Base(path)
+	for _, v := range privateFile {
+		if strings.HasPrefix(base, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed report true if request user has perm of path, path relative to rootDir
+func allowed(r *http.Request, path string, perm lib.Perm) bool {
+	if flagReadonly && perm > lib.PermRead {
+		return false
+	}
+	u := requestUser(r)
+	if u == nil {
+		return !flagAuth
+	}
+	return u.Allowed(path, perm) && trashAllowed(u, path, func(origin string) bool {
+		return u.Allowed(origin, perm)
+	})
+}
+
+// visible report true if request user can read path or something under it
+func visible(r *http.Request, path string) bool {
+	u := requestUser(r)
+	if u == nil {
+		return !flagAuth
+	}
+	return u.Visible(path) && trashAllowed(u, path, u.Visible)
+}
+
+// readableTree report true if request user can read everything under path,
+// trash has perm of each file so it is only whole for admin
+func readableTree(r *http.Request, path string) bool {
+	u := requestUser(r)
+	if u == nil {
+		return !flagAuth
+	}
+	path = strings.Trim(path, "/")
+	if path == "." {
+		path = ""
+	}
+	if u.Role != lib.RoleAdmin && (len(path) == 0 || path == ".Trash" || strings.HasPrefix(path, ".Trash/")) {
+		return false
+	}
+	return u.AllowedTree(path, lib.PermRead)
+}
+
+// trashAllowed check file in trash by path it deleted from, trash is shared
+// by all users, origin is found in audit and unknown origin is admin only
+func trashAllowed(u *lib.User, path string, check func(origin string) bool) bool {
+	path = strings.Trim(path, "/")
+	if u.Role == lib.RoleAdmin || !strings.HasPrefix(path, ".Trash/") {
+		return true
+	}
+	p := strings.SplitN(path, "/", 3)
+	origin, err := metaV2.MovedFrom(filepath.Join(p[0], p[1]))
+	if err != nil {
+		return false
+	}
+	if len(p) == 3 {
+		origin = filepath.Join(origin, p[2])
+	}
+	return check(origin)
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api") {
+		NewStatusResp(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
+// operationPerm return perm needed by operation action
+func operationPerm(action string) lib.Perm {
+	switch strings.Split(action, "=")[0] {
+	case "delete", "restore", "dedupe":
+		return lib.PermDelete
+	case "torrent":
+		// delete remove torrent and trash its files
+		if action == "torrent=delete" {
+			return lib.PermDelete
+		}
+	}
+	return lib.PermWrite
+}
+
+// withPerm wrap file handler, check read perm of url path,
+// url path already decoded so escaped separator is part of name
+func withPerm(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, _, err := resolvePath(r.URL.Path)
+		if err != nil {
+			forbidden(w, r)
+			return
+		}
+		if isPrivate(path) {
+			http.NotFound(w, r)
+			return
+		}
+		if !allowed(r, path, lib.PermRead) {
+			forbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// davPerm return perm needed by webdav method
+func davPerm(method string) lib.Perm {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return lib.PermRead
+	case "DELETE", "MOVE":
+		return lib.PermDelete
+	}
+	return lib.PermWrite
+}
+
+// davAllowed check perm of webdav request, include destination of MOVE and COPY
+func davAllowed(r *http.Request, fs *davFS) bool {
+	path := fs.rel(strings.TrimPrefix(r.URL.Path, davPrefix))
+	if isPrivate(path) {
+		return false
+	}
+	if !allowed(r, path, davPerm(r.Method)) {
+		return false
+	}
+	if dst := r.Header.Get("Destination"); len(dst) > 0 {
+		u, err := url.Parse(dst)
+		if err != nil {
+			return false
+		}
+		dstPath := fs.rel(strings.TrimPrefix(u.Path, davPrefix))
+		if isPrivate(dstPath) || !allowed(r, dstPath, lib.PermWrite) {
+			return false
+		}
+	}
+	return true
+}
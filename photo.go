@@ -11,6 +11,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+
+	"github.com/kiyor/k2fs/lib"
 )
 
 var (
@@ -52,13 +54,16 @@ func imagesList(images Images) template.JS {
 
 func renderPhoto(w http.ResponseWriter, r *http.Request) {
 	// trim /photo/test -> test
-	path := r.URL.Path[len("/photo/"):]
-	dir := filepath.Join(rootDir, path)
+	path, dir, err := resolvePath(r.URL.Path[len("/photo/"):])
+	if err != nil || !visible(r, path) {
+		forbidden(w, r)
+		return
+	}
 
 	var images Images
 
 	images.Title = filepath.Base(dir)
-	fs := readDir2(dir)
+	fs := filterReadable(r, readDir2(dir))
 	if len(fs) == 0 {
 		http.Redirect(w, r, "/"+path, 302)
 		return
@@ -91,16 +96,36 @@ func readDir(path string) (fs []os.DirEntry) {
 		log.Println(err)
 	}
 	for _, f := range files {
-		for _, ext := range photoExt {
-			if strings.ToLower(filepath.Ext(f.Name())) == ext {
-				fs = append(fs, f)
-				break
-			}
+		if isPhoto(f.Name()) {
+			fs = append(fs, f)
 		}
 	}
 	return
 }
 
+// filterReadable remove file request user can not read, fs from readDir2
+func filterReadable(r *http.Request, fs []string) []string {
+	var out []string
+	for _, f := range fs {
+		if allowed(r, f, lib.PermRead) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func isPhoto(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	for _, v := range photoExt {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
 func readDir2(path string) (fs []string) {
 	err := filepath.Walk(path, func(p string, i os.FileInfo, err error) error {
 		if err != nil {
@@ -109,13 +134,10 @@ func readDir2(path string) (fs []string) {
 		if strings.HasPrefix(i.Name(), "._") {
 			return nil
 		}
-		for _, ext := range photoExt {
-			if strings.ToLower(filepath.Ext(p)) == ext {
-				f := p[len(rootDir):]
-				// 				log.Println(f)
-				fs = append(fs, f)
-				break
-			}
+		if isPhoto(p) {
+			f := p[len(rootDir):]
+			// 				log.Println(f)
+			fs = append(fs, f)
 		}
 		return err
 	})
@@ -2,8 +2,9 @@ package main
 
 import (
 	_ "embed"
+	"html/template"
 	"net/http"
-	"text/template"
+	"net/url"
 )
 
 var (
@@ -11,8 +12,21 @@ var (
 	playerTmpl string
 )
 
+type Player struct {
+	Query  url.Values
+	Tracks []*Subtitle
+	Resume float64
+}
+
 func renderPlayer(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
+	p := &Player{
+		Query: query,
+	}
+	if path, _, err := resolvePath(query.Get("path")); err == nil && len(path) > 0 {
+		p.Tracks = findSubtitles(path)
+		p.Resume = resumePosition(path, currentUser(r))
+	}
 	t := template.Must(template.New("player").Parse(playerTmpl))
-	t.Execute(w, query)
+	t.Execute(w, p)
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// naturalLess compare string with number inside by value, ep2 < ep10
+func naturalLess(a, b string) bool {
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si := i
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			sj := j
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			na := strings.TrimLeft(a[si:i], "0")
+			nb := strings.TrimLeft(b[sj:j], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		ca, cb := strings.ToLower(a[i:i+1]), strings.ToLower(b[j:j+1])
+		if ca != cb {
+			return ca < cb
+		}
+		i++
+		j++
+	}
+	return len(a)-i < len(b)-j
+}
+
+// siblingVideos return video next to path in natural order, path relative to rootDir
+func siblingVideos(path string) ([]string, error) {
+	path = strings.TrimLeft(path, "/")
+	dir := filepath.Dir(path)
+	files, err := os.ReadDir(filepath.Join(rootDir, dir))
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, f := range files {
+		if f.IsDir() || !isVideo(f.Name()) || needHide(f.Name()) || strings.HasPrefix(f.Name(), "._") {
+			continue
+		}
+		list = append(list, filepath.Join(dir, f.Name()))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return naturalLess(filepath.Base(list[i]), filepath.Base(list[j]))
+	})
+	return list, nil
+}
+
+type PlayItem struct {
+	Name    string
+	Path    string
+	Url     string
+	Player  string
+	Watched bool
+}
+
+type PlayList struct {
+	Current int
+	Items   []*PlayItem
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+}
+
+// playlistLink return playlist link for external player, empty if player can not open playlist
+func playlistLink(r *http.Request, openWith, host, path string) string {
+	q := url.Values{"path": {"/" + path}, "format": {"m3u8"}}
+	link := signLink(r, host+"/playlist?"+q.Encode(), "/playlist", q)
+	switch openWith {
+	case "iina":
+		return "iina://open?" + url.Values{"url": {link}}.Encode()
+	case "vlc":
+		q.Set("format", "xspf")
+		return "vlc://" + signLink(r, host+"/playlist?"+q.Encode(), "/playlist", q)
+	case "nplayer":
+		return "nplayer-" + link
+	}
+	return ""
+}
+
+// renderPlaylist
+// /playlist?path=/a/ep1.mkv&format=m3u8|xspf|json
+func renderPlaylist(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	path, _, err := resolvePath(q.Get("path"))
+	if err != nil {
+		forbidden(w, r)
+		return
+	}
+	if !isVideo(path) {
+		http.Error(w, "not a video", http.StatusBadRequest)
+		return
+	}
+	if !allowed(r, path, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	list, err := siblingVideos(path)
+	if err != nil {
+		log.Println(err)
+		http.NotFound(w, r)
+		return
+	}
+	host := req2map(r)["host"].(string)
+	pl := &PlayList{}
+	progress, _ := metaV2.ListProgress(filepath.Dir(path), currentUser(r))
+	for k, v := range list {
+		if v == path {
+			pl.Current = k
+		}
+		item := &PlayItem{
+			Name:   filepath.Base(v),
+			Path:   "/" + v,
+			Url:    signLink(r, host+(&url.URL{Path: "/statics/" + v}).String(), "/statics/"+v, nil),
+			Player: "/player?" + videoQuery(r, host, v),
+		}
+		if p, ok := progress[v]; ok {
+			item.Watched = p.Watched
+		}
+		pl.Items = append(pl.Items, item)
+	}
+	title := filepath.Base(filepath.Dir("/" + path))
+	// external player start from selected video, built-in player get whole queue
+	switch q.Get("format") {
+	case "json":
+		NewResp(w, pl, nil)
+	case "xspf":
+		x := xspfPlaylist{
+			Version: "1",
+			Xmlns:   "http://xspf.org/ns/0/",
+			Title:   title,
+		}
+		for _, v := range pl.Items[pl.Current:] {
+			x.Tracks = append(x.Tracks, xspfTrack{Location: v.Url, Title: v.Name})
+		}
+		w.Header().Set("Content-Type", "application/xspf+xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", title+".xspf"))
+		w.Write([]byte(xml.Header))
+		encoder := xml.NewEncoder(w)
+		encoder.Indent("", "  ")
+		err = encoder.Encode(x)
+		if err != nil {
+			log.Println(err)
+		}
+	default:
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", title+".m3u8"))
+		fmt.Fprintln(w, "#EXTM3U")
+		fmt.Fprintf(w, "#PLAYLIST:%s\n", title)
+		for _, v := range pl.Items[pl.Current:] {
+			fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", v.Name, v.Url)
+		}
+	}
+}
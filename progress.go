@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// Progress api request, player report playback position
+type Progress struct {
+	Path     string  `json:"path"`
+	Position float64 `json:"position"`
+	Duration float64 `json:"duration"`
+	Watched  *bool   `json:"watched"`
+}
+
+func apiProgress(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	user := currentUser(r)
+	if r.Method == http.MethodGet {
+		path, _, err := resolvePath(r.URL.Query().Get("path"))
+		if err != nil || !allowed(r, path, lib.PermRead) {
+			forbidden(w, r)
+			return
+		}
+		p, err := metaV2.GetProgress(path, user)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, p, nil)
+		return
+	}
+	var req Progress
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	req.Path, _, err = resolvePath(req.Path)
+	if err != nil {
+		forbidden(w, r)
+		return
+	}
+	if !isVideo(req.Path) {
+		NewResp(w, "not a video", nil, 1)
+		return
+	}
+	if !allowed(r, req.Path, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	p := &lib.WatchProgress{
+		Path:     req.Path,
+		User:     user,
+		Position: req.Position,
+		Duration: req.Duration,
+	}
+	if old, err := metaV2.GetProgress(req.Path, user); err == nil {
+		p.Watched = old.Watched
+	}
+	if req.Watched != nil {
+		p.Watched = *req.Watched
+		if !p.Watched {
+			p.Position = 0
+		}
+	}
+	err = metaV2.SetProgress(p)
+	if err != nil {
+		log.Println(err)
+		NewErrResp(w, 1, err)
+		return
+	}
+	NewResp(w, p, nil)
+}
+
+// resumePosition return saved position of path, 0 if watched or never played
+func resumePosition(path, user string) float64 {
+	p, err := metaV2.GetProgress(path, user)
+	if err != nil || p.Watched {
+		return 0
+	}
+	return p.Position
+}
+
+// fillProgress set watched state of video and unwatched count of dir under path
+func fillProgress(files Files, path, user string) {
+	prefix := strings.Trim(path, "/")
+	progress, err := metaV2.ListProgress(prefix, user)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var hasDir bool
+	for _, f := range files {
+		if f.IsDir {
+			hasDir = true
+			continue
+		}
+		if p, ok := progress[f.Path]; ok {
+			f.Watched = p.Watched
+			f.Progress = p.Progress()
+		}
+	}
+	if !hasDir {
+		return
+	}
+	unwatched, err := metaV2.CountUnwatched(prefix, user, videoExts())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, f := range files {
+		if f.IsDir {
+			f.Unwatched = unwatched[f.Path]
+		}
+	}
+}
+
+// onlyUnwatched keep unwatched video and dir still have unwatched video
+func onlyUnwatched(files Files) Files {
+	var out Files
+	for _, f := range files {
+		if f.IsDir && f.Unwatched > 0 {
+			out = append(out, f)
+		}
+		if !f.IsDir && isVideo(f.Name) && !f.Watched {
+			out = append(out, f)
+		}
+	}
+	return out
+}
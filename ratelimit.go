@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limit of endpoint, zero value of each field is unlimited
+type Limit struct {
+	Rate       float64 // request per second of each client
+	Burst      int
+	Concurrent int   // max running request of all client
+	Body       int64 // max request body bytes
+
+	once    sync.Once
+	sem     chan struct{}
+	mu      sync.Mutex
+	clients map[string]*limitClient
+}
+
+type limitClient struct {
+	*rate.Limiter
+	seen time.Time
+}
+
+// default limit, overwrite by -limit
+var limits = map[string]*Limit{
+	"api":     {Rate: 20, Burst: 40, Body: 1 << 20},
+	"search":  {Rate: 0.5, Burst: 3, Concurrent: 2},
+	"thumb":   {Rate: 5, Burst: 10, Concurrent: 4},
+	"unzip":   {Rate: 0.2, Burst: 2, Concurrent: 1},
+	"upload":  {Concurrent: 4},
+	"du":      {Rate: 1, Burst: 5, Concurrent: 2},
+	"torrent": {Rate: 1, Burst: 10, Concurrent: 2, Body: 32 << 20},
+}
+
+// parseLimit parse flag like search:rate=1,burst=3,concurrent=2,body=1048576
+func parseLimit(s string) error {
+	name, args, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("invalid limit %q", s)
+	}
+	l, ok := limits[name]
+	if !ok {
+		return fmt.Errorf("unknown limit endpoint %q", name)
+	}
+	for _, v := range strings.Split(args, ",") {
+		k, val, _ := strings.Cut(v, "=")
+		var err error
+		switch k {
+		case "rate":
+			l.Rate, err = strconv.ParseFloat(val, 64)
+		case "burst":
+			l.Burst, err = strconv.Atoi(val)
+		case "concurrent":
+			l.Concurrent, err = strconv.Atoi(val)
+		case "body":
+			l.Body, err = strconv.ParseInt(val, 10, 64)
+		default:
+			err = fmt.Errorf("unknown limit %q", k)
+		}
+		if err != nil {
+			return fmt.Errorf("limit %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (l *Limit) init() {
+	if l.Concurrent > 0 {
+		l.sem = make(chan struct{}, l.Concurrent)
+	}
+	l.clients = make(map[string]*limitClient)
+}
+
+// allow report if client still has token, or how long to wait
+func (l *Limit) allow(key string) (bool, time.Duration) {
+	if l.Rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	c, ok := l.clients[key]
+	if !ok {
+		// forget idle client
+		if len(l.clients) > 1024 {
+			for k, v := range l.clients {
+				if now.Sub(v.seen) > 10*time.Minute {
+					delete(l.clients, k)
+				}
+			}
+		}
+		burst := l.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		c = &limitClient{Limiter: rate.NewLimiter(rate.Limit(l.Rate), burst)}
+		l.clients[key] = c
+	}
+	c.seen = now
+	res := c.ReserveN(now, 1)
+	if !res.OK() {
+		return false, time.Second
+	}
+	if d := res.DelayFrom(now); d > 0 {
+		res.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+func (l *Limit) acquire() bool {
+	if l.sem == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Limit) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// limitKey is user if login, or ip of client
+func limitKey(r *http.Request) string {
+	if u := currentUser(r); len(u) > 0 {
+		return "user:" + u
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit check rate and concurrency of endpoint and limit body size,
+// write 429 if exceeded, release must be called when request done
+func rateLimit(w http.ResponseWriter, r *http.Request, name string) (release func(), ok bool) {
+	l, found := limits[name]
+	if !found {
+		return func() {}, true
+	}
+	l.once.Do(l.init)
+	allowed, wait := l.allow(limitKey(r))
+	if allowed && !l.acquire() {
+		allowed, wait = false, time.Second
+	} else if allowed {
+		release = l.release
+	}
+	if !allowed {
+		tooManyRequests(w, r, wait)
+		return nil, false
+	}
+	if l.Body > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, l.Body)
+	}
+	return release, true
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if strings.HasPrefix(r.URL.Path, "/api") {
+		NewStatusResp(w, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
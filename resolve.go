@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRoot = errors.New("path outside root")
+
+// real path of rootDir, symlink in root itself is fine
+var rootReal string
+
+func initResolver() {
+	var err error
+	rootReal, err = filepath.EvalSymlinks(rootDir)
+	if err != nil {
+		rootReal = rootDir
+	}
+}
+
+func inRoot(root, p string) bool {
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// resolvePath clean path from client, return it relative to rootDir and absolute,
+// reject path escape root by .. or, unless -follow-symlinks, by symlink
+func resolvePath(p string) (string, string, error) {
+	if strings.ContainsRune(p, 0) {
+		return "", "", errOutsideRoot
+	}
+	rel := path.Clean(strings.TrimLeft(filepath.ToSlash(p), "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", "", errOutsideRoot
+	}
+	if rel == "." {
+		rel = ""
+	}
+	abs := filepath.Join(rootDir, rel)
+	if flagFollowSymlinks {
+		return rel, abs, nil
+	}
+	// file may not exist yet like upload or mkdir, check the nearest exist parent
+	for p := abs; inRoot(rootDir, p); p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil || !inRoot(rootReal, real) {
+			return "", "", errOutsideRoot
+		}
+		break
+	}
+	return rel, abs, nil
+}
+
+func isSymlink(abs string) bool {
+	f, err := os.Lstat(abs)
+	return err == nil && f.Mode()&os.ModeSymlink != 0
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setRoot point rootDir to a temp dir with file a/b.txt, symlink in.txt to
+// a/b.txt and symlink out to dir outside root
+func setRoot(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "root2")
+	for _, d := range []string{filepath.Join(root, "a"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "a", "b.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("s"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a", "b.txt"), filepath.Join(root, "in.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	oldRoot, oldReal, oldFollow := rootDir, rootReal, flagFollowSymlinks
+	t.Cleanup(func() {
+		rootDir, rootReal, flagFollowSymlinks = oldRoot, oldReal, oldFollow
+	})
+	rootDir = root
+	flagFollowSymlinks = false
+	initResolver()
+	return root
+}
+
+func TestResolvePath(t *testing.T) {
+	root := setRoot(t)
+	cases := []struct {
+		in  string
+		rel string
+		ok  bool
+	}{
+		{"", "", true},
+		{"/", "", true},
+		{"/a/b.txt", "a/b.txt", true},
+		{"a/./b.txt", "a/b.txt", true},
+		{"/a/../a/b.txt", "a/b.txt", true},
+		// absolute path is relative to root
+		{"/etc/passwd", "etc/passwd", true},
+		{"//etc/passwd", "etc/passwd", true},
+		// not exist yet like mkdir
+		{"/a/new/dir", "a/new/dir", true},
+		{"../x", "", false},
+		{"..", "", false},
+		{"a/../../x", "", false},
+		{"/a/../../x", "", false},
+		{"a/b.txt/../../../x", "", false},
+		{"a\x00b", "", false},
+		// symlink inside root point inside root
+		{"/in.txt", "in.txt", true},
+		// symlink inside root point outside root
+		{"/out", "", false},
+		{"/out/secret.txt", "", false},
+		{"/out/new.txt", "", false},
+	}
+	for _, c := range cases {
+		rel, abs, err := resolvePath(c.in)
+		if (err == nil) != c.ok {
+			t.Errorf("resolvePath(%q) err = %v, want ok %v", c.in, err, c.ok)
+			continue
+		}
+		if !c.ok {
+			continue
+		}
+		if rel != c.rel {
+			t.Errorf("resolvePath(%q) rel = %q, want %q", c.in, rel, c.rel)
+		}
+		if want := filepath.Join(root, c.rel); abs != want {
+			t.Errorf("resolvePath(%q) abs = %q, want %q", c.in, abs, want)
+		}
+	}
+}
+
+func TestResolvePathFollowSymlinks(t *testing.T) {
+	setRoot(t)
+	flagFollowSymlinks = true
+	if _, _, err := resolvePath("/out/secret.txt"); err != nil {
+		t.Errorf("follow symlinks: %v", err)
+	}
+	if _, _, err := resolvePath("../x"); err == nil {
+		t.Error("follow symlinks: .. should still be rejected")
+	}
+}
+
+func TestResolvePathSystemRoot(t *testing.T) {
+	oldRoot, oldReal, oldFollow := rootDir, rootReal, flagFollowSymlinks
+	defer func() {
+		rootDir, rootReal, flagFollowSymlinks = oldRoot, oldReal, oldFollow
+	}()
+	rootDir = "/"
+	flagFollowSymlinks = false
+	initResolver()
+	rel, abs, err := resolvePath("/tmp/new")
+	if err != nil || rel != "tmp/new" || abs != "/tmp/new" {
+		t.Errorf("resolvePath(/tmp/new) = %q, %q, %v", rel, abs, err)
+	}
+}
+
+func TestInRoot(t *testing.T) {
+	cases := []struct {
+		root, p string
+		want    bool
+	}{
+		{"/r", "/r", true},
+		{"/r", "/r/a", true},
+		{"/r", "/r2", false},
+		{"/r", "/r2/a", false},
+		{"/r", "/", false},
+		{"/", "/", true},
+		{"/", "/a", true},
+	}
+	for _, c := range cases {
+		if got := inRoot(c.root, c.p); got != c.want {
+			t.Errorf("inRoot(%q, %q) = %v, want %v", c.root, c.p, got, c.want)
+		}
+	}
+}
+
+func TestIsSymlink(t *testing.T) {
+	root := setRoot(t)
+	if !isSymlink(filepath.Join(root, "out")) {
+		t.Error("out should be symlink")
+	}
+	if isSymlink(filepath.Join(root, "a")) {
+		t.Error("a should not be symlink")
+	}
+	if isSymlink(filepath.Join(root, "missing")) {
+		t.Error("missing should not be symlink")
+	}
+}
+
+func TestWithPerm(t *testing.T) {
+	setRoot(t)
+	oldAuth, oldReadonly := flagAuth, flagReadonly
+	t.Cleanup(func() { flagAuth, flagReadonly = oldAuth, oldReadonly })
+	flagAuth, flagReadonly = false, false
+	h := http.StripPrefix("/statics", withPerm(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	cases := []struct {
+		target string
+		code   int
+	}{
+		{"/statics/a/b.txt", http.StatusOK},
+		{"/statics/in.txt", http.StatusOK},
+		{"/statics/a%2Fb.txt", http.StatusOK},
+		{"/statics/../x", http.StatusForbidden},
+		{"/statics/a/../../x", http.StatusForbidden},
+		{"/statics/%2e%2e%2fx", http.StatusForbidden},
+		{"/statics/%2E%2E/x", http.StatusForbidden},
+		{"/statics/a%2F..%2F..%2Fx", http.StatusForbidden},
+		{"/statics/out/secret.txt", http.StatusForbidden},
+		{"/statics/out%2Fsecret.txt", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.target, nil))
+		if w.Code != c.code {
+			t.Errorf("GET %s = %d, want %d", c.target, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+	"golang.org/x/time/rate"
+)
+
+var scrubRunning atomic.Bool
+
+// throttleReader limit read of scrub to bytes per second
+type throttleReader struct {
+	r io.Reader
+	l *rate.Limiter
+}
+
+func (t *throttleReader) Read(p []byte) (int, error) {
+	if len(p) > t.l.Burst() {
+		p = p[:t.l.Burst()]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.l.WaitN(appCtx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// throttle return reader wrap share one limiter, nil if not limited
+func throttle(bytesPerSec int64) func(io.Reader) io.Reader {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	burst := int(bytesPerSec)
+	if burst > 1<<20 {
+		burst = 1 << 20
+	}
+	l := rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+	return func(r io.Reader) io.Reader {
+		return &throttleReader{r: r, l: l}
+	}
+}
+
+// scrubFiles verify file under prefix, skip if already running
+func scrubFiles(prefix string) {
+	if !scrubRunning.CompareAndSwap(false, true) {
+		return
+	}
+	defer scrubRunning.Store(false)
+	t1 := time.Now()
+	s := &lib.Scrub{Prefix: prefix, Wrap: throttle(flagScrubRate)}
+	err := s.Run(metaV2)
+	if err != nil {
+		// stopped by shutdown, file not verified yet keep its state
+		log.Println("scrub", "/"+prefix, "stopped", s.Verified, "verified", s.Mismatch, "mismatch", s.Corrupt, "corrupt", time.Since(t1), err)
+		return
+	}
+	log.Println("scrub", "/"+prefix, "done", s.Verified, "verified", s.Mismatch, "mismatch", s.Corrupt, "corrupt", time.Since(t1), err)
+}
+
+// IntegrityRequest integrity api request
+type IntegrityRequest struct {
+	Action string `json:"action"` // empty list file failed verification, scrub start scrub of path
+	Path   string `json:"path"`
+}
+
+func apiIntegrity(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req IntegrityRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	rel, _, err := resolvePath(req.Path)
+	if err != nil || !allowed(r, rel, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	switch req.Action {
+	case "":
+		list, err := metaV2.ListBroken(rel)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		out := make(lib.MetaInfoV2s, 0, len(list))
+		for _, i := range list {
+			if visible(r, i.Path) && !isPrivate(i.Path) {
+				out = append(out, i)
+			}
+		}
+		NewResp(w, out, nil)
+	case "scrub":
+		if u := requestUser(r); u != nil && !u.IsAdmin() {
+			forbidden(w, r)
+			return
+		}
+		if scrubRunning.Load() {
+			NewResp(w, "scrub already running", nil)
+			return
+		}
+		if !asyncOps.Go(func() { scrubFiles(rel) }) {
+			NewResp(w, "shutting down", nil, 1)
+			return
+		}
+		NewResp(w, "scrub started", nil)
+	default:
+		NewResp(w, "unknown action "+req.Action, nil, 1)
+	}
+}
+
+// fillIntegrity set integrity of file in list from index
+func fillIntegrity(files Files, path string) {
+	states, err := metaV2.ListIntegrity(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, f := range files {
+		if !f.IsDir {
+			f.Integrity = states[f.Path]
+		}
+	}
+}
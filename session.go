@@ -1,18 +1,50 @@
 package main
 
 import (
+	"encoding/hex"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
-// Note: Don't store your key in your source code. Pass it via an
-// environmental variable, or flag (or both), and don't accidentally commit it
-// alongside your code. Ensure your key is sufficiently random - i.e. use Go's
-// crypto/rand or securecookie.GenerateRandomKey(32) and persist the result.
-// var store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
-var store = sessions.NewCookieStore([]byte("CplRFt9vaVrlZJFB"))
+var (
+	store *sessions.CookieStore
+	// sessionKey also sign link of external player
+	sessionKey []byte
+)
+
+// initSessionStore load session key from flag, env SESSION_KEY or key file,
+// generate and persist a new one to key file if none of them exist
+func initSessionStore(keyFile string) {
+	key := []byte(flagSessionKey)
+	if len(key) == 0 {
+		key = []byte(os.Getenv("SESSION_KEY"))
+	}
+	if len(key) == 0 {
+		if b, err := os.ReadFile(keyFile); err == nil {
+			key, _ = hex.DecodeString(strings.TrimSpace(string(b)))
+		}
+	}
+	if len(key) == 0 {
+		key = securecookie.GenerateRandomKey(32)
+		err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)), 0600)
+		if err != nil {
+			log.Println("session key not persisted", err)
+		} else {
+			log.Println("generate session key", keyFile)
+		}
+	}
+	sessionKey = key
+	store = sessions.NewCookieStore(key)
+	store.Options.HttpOnly = true
+	store.Options.MaxAge = 86400 * 30
+	store.Options.SameSite = http.SameSiteLaxMode
+	store.Options.Secure = tlsEnabled()
+}
 
 func apiSession(w http.ResponseWriter, r *http.Request) {
 	// Get a session. We're ignoring the error resulted from decoding an
@@ -21,6 +53,9 @@ func apiSession(w http.ResponseWriter, r *http.Request) {
 	// Set some session values.
 	q := r.URL.Query()
 	for k, v := range q {
+		if k == sessionUserKey || k == sessionCredKey {
+			continue
+		}
 		session.Values[k] = v
 	}
 	// 	log.Println(session.Values["sortby"])
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// ShareRequest share api request
+type ShareRequest struct {
+	Action       string `json:"action"` // create, list, revoke
+	ID           string `json:"id"`
+	Path         string `json:"path"`
+	Expire       string `json:"expire"` // duration like 24h, empty never expire
+	MaxDownloads int    `json:"max_downloads"`
+	Password     string `json:"password"`
+}
+
+type ShareResp struct {
+	*lib.Share
+	Link string `json:"link"`
+}
+
+func shareLink(r *http.Request, s *lib.Share) *ShareResp {
+	return &ShareResp{
+		Share: s,
+		Link:  req2map(r)["host"].(string) + "/s/" + s.ID,
+	}
+}
+
+func apiShare(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req ShareRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	switch req.Action {
+	case "create":
+		path, abs, err := resolvePath(req.Path)
+		if err != nil || !allowed(r, path, lib.PermWrite) {
+			forbidden(w, r)
+			return
+		}
+		f, err := os.Stat(abs)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		if f.IsDir() {
+			NewResp(w, "can not share dir", nil, 1)
+			return
+		}
+		s := &lib.Share{
+			Path:         path,
+			CreatedBy:    currentUser(r),
+			MaxDownloads: req.MaxDownloads,
+		}
+		if len(req.Expire) > 0 {
+			d, err := time.ParseDuration(req.Expire)
+			if err != nil {
+				NewErrResp(w, 1, err)
+				return
+			}
+			t := time.Now().Add(d)
+			s.ExpiresAt = &t
+		}
+		err = s.SetPassword(req.Password)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		err = metaV2.CreateShare(s)
+		if err != nil {
+			log.Println(err)
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, shareLink(r, s), nil)
+	case "list":
+		list, err := metaV2.ListShares(req.Path)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		var out []*ShareResp
+		for _, s := range list {
+			if !canManageShare(r, s) {
+				continue
+			}
+			out = append(out, shareLink(r, s))
+		}
+		NewResp(w, out, nil)
+	case "revoke":
+		s, err := metaV2.GetShare(req.ID)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		if !canManageShare(r, s) {
+			forbidden(w, r)
+			return
+		}
+		err = metaV2.RevokeShare(s.ID)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, "success", nil)
+	default:
+		NewResp(w, "unknown share action "+req.Action, nil, 1)
+	}
+}
+
+// canManageShare admin and creator of share can list and revoke it
+func canManageShare(r *http.Request, s *lib.Share) bool {
+	if allowed(r, s.Path, lib.PermAdmin) {
+		return true
+	}
+	return s.CreatedBy == currentUser(r) && allowed(r, s.Path, lib.PermWrite)
+}
+
+// serveShare /s/<id>
+func serveShare(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/s/"), "/")
+	s, err := metaV2.GetShare(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := s.Valid(); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if s.HasPassword {
+		password := r.URL.Query().Get("password")
+		if _, p, ok := r.BasicAuth(); ok {
+			password = p
+		}
+		if !s.CheckPassword(password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="k2fs share"`)
+			http.Error(w, "password required", http.StatusUnauthorized)
+			return
+		}
+	}
+	if isPrivate(s.Path) {
+		http.NotFound(w, r)
+		return
+	}
+	_, abs, err := resolvePath(s.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	// only count the first request of a download, player resume with range
+	rg := r.Header.Get("Range")
+	if r.Method != http.MethodHead && (len(rg) == 0 || strings.HasPrefix(rg, "bytes=0-")) {
+		err := metaV2.CountShareDownload(s)
+		if errors.Is(err, lib.ErrShareExceeded) {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if len(flagStaticFileHost) > 0 && !s.HasPassword && s.MaxDownloads == 0 {
+		http.Redirect(w, r, flagStaticFileHost+(&url.URL{Path: "/statics/" + s.Path}).String(), http.StatusFound)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
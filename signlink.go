@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// signedLinkTTL is how long link for external player is valid
+const signedLinkTTL = 12 * time.Hour
+
+// errBadSignature is signed link invalid or expired
+var errBadSignature = errors.New("invalid or expired link")
+
+// linkSignature sign user, expiry and target of link, password hash is in
+// it so link stop working after password changed
+func linkSignature(u *lib.User, exp, target string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(u.Name + "\n" + u.PasswordHash + "\n" + exp + "\n" + target))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// linkTarget is what signed of request, path of file or path of playlist
+func linkTarget(path string, q url.Values) string {
+	if path == "/playlist" {
+		return path + "\n" + q.Get("path")
+	}
+	return path
+}
+
+// signQuery return query to append to link of path, so external player
+// without session cookie can read it, empty if auth disabled
+func signQuery(r *http.Request, path string, q url.Values) string {
+	u := requestUser(r)
+	if u == nil || len(sessionKey) == 0 {
+		return ""
+	}
+	exp := strconv.FormatInt(time.Now().Add(signedLinkTTL).Unix(), 10)
+	return url.Values{
+		"u":   {u.Name},
+		"exp": {exp},
+		"sig": {linkSignature(u, exp, linkTarget(path, q))},
+	}.Encode()
+}
+
+// signLink append signature to link, link is host and path with query
+func signLink(r *http.Request, link, path string, q url.Values) string {
+	s := signQuery(r, path, q)
+	if len(s) == 0 {
+		return link
+	}
+	if strings.Contains(link, "?") {
+		return link + "&" + s
+	}
+	return link + "?" + s
+}
+
+// signedUser return user of signed link, read only
+func signedUser(r *http.Request) (*lib.User, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, errBadSignature
+	}
+	if !strings.HasPrefix(r.URL.Path, "/statics/") && r.URL.Path != "/playlist" {
+		return nil, errBadSignature
+	}
+	q := r.URL.Query()
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return nil, errBadSignature
+	}
+	u, err := metaV2.GetUser(q.Get("u"))
+	if err != nil {
+		return nil, errBadSignature
+	}
+	if !hmac.Equal([]byte(q.Get("sig")), []byte(linkSignature(u, q.Get("exp"), linkTarget(r.URL.Path, q)))) {
+		return nil, errBadSignature
+	}
+	u.Scope = lib.PermRead
+	return u, nil
+}
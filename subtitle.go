@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+var subtitleExt = []string{
+	".srt",
+	".ass",
+	".ssa",
+	".vtt",
+}
+
+func isSubtitle(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, v := range subtitleExt {
+		if v == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// Subtitle is a sidecar subtitle track of a video
+type Subtitle struct {
+	Name  string
+	Lang  string
+	Label string
+	Src   string
+}
+
+// isSubtitleSidecar report true if path is a subtitle and a video with the same basename is next to it
+// movie.mkv + movie.srt / movie.en.srt / movie.chs.ass
+func isSubtitleSidecar(path string) bool {
+	if !isSubtitle(path) {
+		return false
+	}
+	dir := filepath.Dir(path)
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for {
+		for _, ext := range videoExts() {
+			if _, err := os.Stat(filepath.Join(dir, base+ext)); err == nil {
+				return true
+			}
+		}
+		i := strings.LastIndex(base, ".")
+		if i <= 0 {
+			return false
+		}
+		base = base[:i]
+	}
+}
+
+// findSubtitles find subtitle sidecars of video, path is relative to rootDir
+func findSubtitles(path string) []*Subtitle {
+	path = strings.TrimLeft(path, "/")
+	abs := filepath.Join(rootDir, path)
+	dir := filepath.Dir(abs)
+	base := strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var subs []*Subtitle
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !isSubtitle(name) || !strings.HasPrefix(name, base) {
+			continue
+		}
+		// movie.en.srt -> .en
+		middle := strings.TrimSuffix(name[len(base):], filepath.Ext(name))
+		if len(middle) > 0 && middle[0] != '.' {
+			continue
+		}
+		lang := strings.Trim(middle, ".")
+		label := lang
+		if len(label) == 0 {
+			label = strings.ToUpper(strings.TrimPrefix(filepath.Ext(name), "."))
+		}
+		rel := filepath.Join(filepath.Dir(path), name)
+		subs = append(subs, &Subtitle{
+			Name:  name,
+			Lang:  lang,
+			Label: label,
+			Src:   "/subtitle?" + url.Values{"path": {"/" + rel}}.Encode(),
+		})
+	}
+	return subs
+}
+
+// renderSubtitle serve subtitle as WebVTT
+func renderSubtitle(w http.ResponseWriter, r *http.Request) {
+	path, abs, err := resolvePath(r.URL.Query().Get("path"))
+	if err != nil {
+		forbidden(w, r)
+		return
+	}
+	if !isSubtitle(path) {
+		http.Error(w, "not a subtitle", http.StatusBadRequest)
+		return
+	}
+	if !allowed(r, path, lib.PermRead) {
+		forbidden(w, r)
+		return
+	}
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".srt":
+		b = srt2vtt(b)
+	case ".ass", ".ssa":
+		b = ass2vtt(b)
+	}
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(b)
+}
+
+var reSrtTime = regexp.MustCompile(`(\d{1,2}:\d{2}:\d{2}),(\d{3})`)
+
+func srt2vtt(b []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	buf.Write(reSrtTime.ReplaceAll(b, []byte("$1.$2")))
+	return buf.Bytes()
+}
+
+var (
+	reAssTag   = regexp.MustCompile(`\{[^}]*\}`)
+	reAssBreak = strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ")
+)
+
+func ass2vtt(b []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n\n")
+	var inEvents bool
+	var format []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Format":
+			format = strings.Split(val, ",")
+			for k, v := range format {
+				format[k] = strings.TrimSpace(v)
+			}
+		case "Dialogue":
+			if len(format) == 0 {
+				continue
+			}
+			fields := strings.SplitN(strings.TrimSpace(val), ",", len(format))
+			if len(fields) != len(format) {
+				continue
+			}
+			var start, end, text string
+			for k, v := range format {
+				switch v {
+				case "Start":
+					start = assTime(fields[k])
+				case "End":
+					end = assTime(fields[k])
+				case "Text":
+					text = fields[k]
+				}
+			}
+			text = strings.TrimSpace(reAssBreak.Replace(reAssTag.ReplaceAllString(text, "")))
+			if len(start) == 0 || len(end) == 0 || len(text) == 0 {
+				continue
+			}
+			fmt.Fprintf(&buf, "%s --> %s\n%s\n\n", start, end, text)
+		}
+	}
+	return buf.Bytes()
+}
+
+// assTime 0:01:02.30 -> 00:01:02.300
+func assTime(s string) string {
+	var h, m, sec, cs int
+	_, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d:%d.%d", &h, &m, &sec, &cs)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", h, m, sec, cs*10)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// self signed ca and cert persisted in db dir
+const (
+	tlsCAFile   = ".kfs_ca.crt"
+	tlsCAKey    = ".kfs_ca.key"
+	tlsCertFile = ".kfs_tls.crt"
+	tlsCertKey  = ".kfs_tls.key"
+)
+
+func tlsEnabled() bool {
+	return len(flagTLSCert) > 0 || flagTLSSelfSigned
+}
+
+// tlsFiles return cert and key file, generate self signed one if needed
+func tlsFiles() (string, string, error) {
+	if len(flagTLSCert) > 0 {
+		if len(flagTLSKey) == 0 {
+			return "", "", errors.New("-tls-key required with -tls-cert")
+		}
+		return flagTLSCert, flagTLSKey, nil
+	}
+	ca, caKey, err := loadOrCreateCA()
+	if err != nil {
+		return "", "", err
+	}
+	cert, key := filepath.Join(dbDir, tlsCertFile), filepath.Join(dbDir, tlsCertKey)
+	if c, err := tls.LoadX509KeyPair(cert, key); err == nil {
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > 30*24*time.Hour && coverHosts(leaf, tlsHosts()) {
+			return cert, key, nil
+		}
+	}
+	log.Println("generate self signed cert", cert)
+	return cert, key, createCert(ca, caKey, tlsHosts(), cert, key)
+}
+
+// tlsHosts return name and ip the self signed cert valid for
+func tlsHosts() []string {
+	hosts := []string{"localhost"}
+	if h, err := os.Hostname(); err == nil {
+		hosts = append(hosts, h)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+	for _, v := range strings.Split(flagTLSHosts, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			hosts = append(hosts, v)
+		}
+	}
+	return hosts
+}
+
+func coverHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, h := range hosts {
+		if cert.VerifyHostname(h) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePem(file, typ string, b []byte, perm os.FileMode) error {
+	return os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}), perm)
+}
+
+func loadOrCreateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := filepath.Join(dbDir, tlsCAFile), filepath.Join(dbDir, tlsCAKey)
+	if c, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		ca, err := x509.ParseCertificate(c.Certificate[0])
+		if key, ok := c.PrivateKey.(*ecdsa.PrivateKey); ok && err == nil && time.Now().Before(ca.NotAfter) {
+			return ca, key, nil
+		}
+	}
+	log.Println("generate self signed ca", certFile)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: APP + " local CA", Organization: []string{APP}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writePem(keyFile, "EC PRIVATE KEY", b, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePem(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+func createCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{APP}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		// apple refuse cert valid longer than 825 days
+		NotAfter:    time.Now().AddDate(0, 0, 825),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePem(keyFile, "EC PRIVATE KEY", b, 0600); err != nil {
+		return err
+	}
+	return writePem(certFile, "CERTIFICATE", der, 0644)
+}
+
+// serveCA let client download and trust the self signed ca
+func serveCA(w http.ResponseWriter, r *http.Request) {
+	if !flagTLSSelfSigned {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+APP+`-ca.crt"`)
+	http.ServeFile(w, r, filepath.Join(dbDir, tlsCAFile))
+}
+
+// redirectServer return plain http server redirect to https
+func redirectServer(addr, tlsAddr string) *http.Server {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if tlsPort != "443" && len(tlsPort) > 0 {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	return &http.Server{Addr: addr, Handler: h}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// TokenRequest token api request
+type TokenRequest struct {
+	Action string `json:"action"` // create, list, revoke
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Scope  string `json:"scope"` // read, operate or admin
+	All    bool   `json:"all"`   // admin list token of all user
+}
+
+type TokenResp struct {
+	*lib.Token
+	Plain string `json:"token"` // only shown once on create
+}
+
+func apiToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req TokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	me := requestUser(r)
+	if me == nil {
+		NewResp(w, "auth disabled", nil, 1)
+		return
+	}
+	// token can not create or revoke token
+	if me.Scope > lib.PermNone && req.Action != "list" {
+		NewStatusResp(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	switch req.Action {
+	case "create":
+		if req.Scope == "admin" && !me.IsAdmin() {
+			NewStatusResp(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		t := &lib.Token{
+			Name:  req.Name,
+			User:  me.Name,
+			Scope: req.Scope,
+		}
+		plain, err := metaV2.CreateToken(t)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, &TokenResp{Token: t, Plain: plain}, nil)
+	case "list":
+		user := me.Name
+		if req.All && me.IsAdmin() {
+			user = ""
+		}
+		list, err := metaV2.ListTokens(user)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, list, nil)
+	case "revoke":
+		t, err := metaV2.GetToken(req.ID)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		if t.User != me.Name && !me.IsAdmin() {
+			NewStatusResp(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		err = metaV2.RevokeToken(t.ID)
+		if err != nil {
+			NewErrResp(w, 1, err)
+			return
+		}
+		NewResp(w, "success", nil)
+	default:
+		NewResp(w, "unknown token action "+req.Action, nil, 1)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kiyor/k2fs/lib"
+)
+
+// errInvalidTorrent is torrent or magnet can not be parsed
+var errInvalidTorrent = errors.New("invalid torrent")
+
+// bencodeEnd return end offset of bencoded value start at i
+func bencodeEnd(b []byte, i, depth int) (int, error) {
+	if i >= len(b) || depth > 64 {
+		return 0, errInvalidTorrent
+	}
+	switch c := b[i]; {
+	case c == 'i':
+		j := bytes.IndexByte(b[i:], 'e')
+		if j < 0 {
+			return 0, errInvalidTorrent
+		}
+		return i + j + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for i < len(b) && b[i] != 'e' {
+			var err error
+			if i, err = bencodeEnd(b, i, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		if i >= len(b) {
+			return 0, errInvalidTorrent
+		}
+		return i + 1, nil
+	case c >= '0' && c <= '9':
+		j := bytes.IndexByte(b[i:], ':')
+		if j < 0 {
+			return 0, errInvalidTorrent
+		}
+		n, err := strconv.Atoi(string(b[i : i+j]))
+		end := i + j + 1 + n
+		if err != nil || n < 0 || end > len(b) {
+			return 0, errInvalidTorrent
+		}
+		return end, nil
+	}
+	return 0, errInvalidTorrent
+}
+
+// bencodeDict return raw value of key in bencoded dict
+func bencodeDict(b []byte, key string) ([]byte, error) {
+	if len(b) == 0 || b[0] != 'd' {
+		return nil, errInvalidTorrent
+	}
+	for i := 1; i < len(b) && b[i] != 'e'; {
+		kend, err := bencodeEnd(b, i, 1)
+		if err != nil {
+			return nil, err
+		}
+		vend, err := bencodeEnd(b, kend, 1)
+		if err != nil {
+			return nil, err
+		}
+		if string(b[i:kend]) == strconv.Itoa(len(key))+":"+key {
+			return b[kend:vend], nil
+		}
+		i = vend
+	}
+	return nil, errInvalidTorrent
+}
+
+// parseTorrentFile return info hash and name of .torrent content
+func parseTorrentFile(b []byte) (string, string, error) {
+	info, err := bencodeDict(b, "info")
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha1.Sum(info)
+	var name string
+	if v, err := bencodeDict(info, "name"); err == nil {
+		if _, s, ok := bytes.Cut(v, []byte(":")); ok {
+			name = string(s)
+		}
+	}
+	return hex.EncodeToString(sum[:]), name, nil
+}
+
+// parseMagnet return info hash and display name of magnet link
+func parseMagnet(link string) (string, string, error) {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Scheme != "magnet" {
+		return "", "", errInvalidTorrent
+	}
+	q := u.Query()
+	for _, xt := range q["xt"] {
+		h, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(h) {
+		case 40:
+			if _, err := hex.DecodeString(h); err == nil {
+				return strings.ToLower(h), q.Get("dn"), nil
+			}
+		case 32:
+			if b, err := base32.StdEncoding.DecodeString(strings.ToUpper(h)); err == nil {
+				return hex.EncodeToString(b), q.Get("dn"), nil
+			}
+		}
+	}
+	return "", "", errInvalidTorrent
+}
+
+// toClient convert dir relative to root to save path in client
+func (t *TorrentClient) toClient(rel string) (string, error) {
+	rel = strings.Trim(rel, "/")
+	if len(t.clientDir) > 0 {
+		r, err := filepath.Rel("/"+t.rootPrefix, "/"+rel)
+		if err != nil || strings.HasPrefix(r, "..") {
+			return "", fmt.Errorf("%s is not under map of torrent client %s", rel, t.Name)
+		}
+		return filepath.Join(t.clientDir, r), nil
+	}
+	return filepath.Join(rootDir, rel), nil
+}
+
+// addTorrent hand magnet or .torrent content to client, download to dir
+// relative to root, empty client is first one
+func addTorrent(client, dir, magnet string, file []byte, source, user string) (*lib.TorrentJob, error) {
+	if len(torrentClients) == 0 {
+		return nil, errors.New("no torrent client")
+	}
+	c := torrentClients[0]
+	if len(client) > 0 {
+		if c = torrentClient(client); c == nil {
+			return nil, fmt.Errorf("torrent client %s not found", client)
+		}
+	}
+	a := &TorrentAdd{Magnet: magnet, File: file}
+	var err error
+	if len(magnet) > 0 {
+		a.Hash, a.Name, err = parseMagnet(magnet)
+	} else {
+		a.Hash, a.Name, err = parseTorrentFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if a.SavePath, err = c.toClient(dir); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(appCtx, 30*time.Second)
+	defer cancel()
+	if err := c.backend.Add(ctx, a); err != nil {
+		return nil, err
+	}
+	j := &lib.TorrentJob{
+		Hash:   a.Hash,
+		Client: c.Name,
+		Name:   a.Name,
+		Dir:    strings.Trim(dir, "/"),
+		Source: source,
+		User:   user,
+	}
+	return j, metaV2.SaveTorrentJob(j)
+}
+
+// TorrentAddRequest torrent_add api request
+type TorrentAddRequest struct {
+	Path    string `json:"path"` // dir to download to
+	Magnet  string `json:"magnet"`
+	Torrent []byte `json:"torrent"` // content of .torrent file, base64 in json
+	Client  string `json:"client"`  // name of client, empty is first
+}
+
+func apiTorrentAdd(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var req TorrentAddRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	rel, abs, err := resolvePath(req.Path)
+	if err != nil || isPrivate(rel) || !allowed(r, rel, lib.PermWrite) {
+		forbidden(w, r)
+		return
+	}
+	if f, err := os.Stat(abs); err != nil || !f.IsDir() {
+		NewErrResp(w, 1, fmt.Errorf("%s is not a dir", req.Path))
+		return
+	}
+	source := "upload"
+	if len(req.Magnet) > 0 {
+		source = "magnet"
+	}
+	e := newAudit(r, "api", "torrent_add", rel)
+	j, err := addTorrent(req.Client, rel, req.Magnet, req.Torrent, source, currentUser(r))
+	if j != nil {
+		e.Dst = filepath.Join(rel, j.Name)
+	}
+	audit(e, err)
+	if err != nil {
+		NewErrResp(w, 1, err)
+		return
+	}
+	auditEvent("torrent.added", e)
+	NewResp(w, j, nil)
+}
+
+// watchTorrents add .torrent and .magnet file under watch dir, torrent
+// download to dir of file, file renamed to .added after added or .invalid
+// if can not parse, kept for retry if client failed
+func watchTorrents() {
+	for _, dir := range flagTorrentWatch {
+		filepath.WalkDir(filepath.Join(rootDir, dir), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || appCtx.Err() != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if d.Name() == ".Trash" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(path))
+			if ext != ".torrent" && ext != ".magnet" {
+				return nil
+			}
+			// still being written
+			if info, err := d.Info(); err != nil || time.Since(info.ModTime()) < 2*time.Second {
+				return nil
+			}
+			rel, _ := filepath.Rel(rootDir, path)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil
+			}
+			var links []string
+			if ext == ".magnet" {
+				for _, v := range strings.Split(string(b), "\n") {
+					if v = strings.TrimSpace(v); len(v) > 0 {
+						links = append(links, v)
+					}
+				}
+				if len(links) == 0 {
+					err = errInvalidTorrent
+				}
+			}
+			add := func(magnet string, file []byte) error {
+				e := &lib.AuditEntry{Time: time.Now(), Via: "watch", Action: "torrent_add", Path: rel}
+				j, err := addTorrent("", filepath.Dir(rel), magnet, file, "watch", "")
+				if j != nil {
+					e.Dst = filepath.Join(j.Dir, j.Name)
+				}
+				audit(e, err)
+				if err == nil {
+					auditEvent("torrent.added", e)
+				}
+				return err
+			}
+			if ext == ".magnet" {
+				// line already added is in job table, readd is harmless
+				for _, v := range links {
+					if err = add(v, nil); err != nil {
+						break
+					}
+				}
+			} else {
+				err = add("", b)
+			}
+			switch {
+			case err == nil:
+				err = os.Rename(path, path+".added")
+			case errors.Is(err, errInvalidTorrent):
+				err = os.Rename(path, path+".invalid")
+			}
+			if err != nil {
+				log.Println("torrent watch", rel, err)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// qbittorrent is client of qBittorrent web api v2
+type qbittorrent struct {
+	base   string
+	user   string
+	pass   string
+	client *http.Client
+	mu     sync.Mutex // serialize login
+}
+
+func newQbittorrent(u *url.URL) *qbittorrent {
+	q := &qbittorrent{user: u.User.Username()}
+	q.pass, _ = u.User.Password()
+	b := *u
+	b.User = nil
+	q.base = strings.TrimRight(b.String(), "/")
+	jar, _ := cookiejar.New(nil)
+	q.client = &http.Client{Timeout: 30 * time.Second, Jar: jar}
+	return q
+}
+
+func (q *qbittorrent) login(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	form := url.Values{"username": {q.user}, "password": {q.pass}}
+	req, err := http.NewRequestWithContext(ctx, "POST", q.base+"/api/v2/auth/login", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// csrf check of qbittorrent
+	req.Header.Set("Referer", q.base)
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(b)) != "Ok." {
+		return fmt.Errorf("qbittorrent login failed: %d %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// errNotFound is 404 of endpoint renamed in newer version
+var errNotFound = errors.New("not found")
+
+// post body to api endpoint, login and retry once if forbidden
+func (q *qbittorrent) post(ctx context.Context, endpoint, contentType string, body []byte) ([]byte, error) {
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", q.base+"/api/v2/"+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Referer", q.base)
+		resp, err := q.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusForbidden && retry == 0:
+			if err := q.login(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, errNotFound
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("qbittorrent %s: %d %s", endpoint, resp.StatusCode, b)
+		}
+		return b, nil
+	}
+}
+
+// call post form to api endpoint, json response decoded to out if not nil
+func (q *qbittorrent) call(ctx context.Context, endpoint string, form url.Values, out interface{}) error {
+	b, err := q.post(ctx, endpoint, "application/x-www-form-urlencoded", []byte(form.Encode()))
+	if err != nil || out == nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// qbittorrentState map state of qbittorrent to normalized state
+func qbittorrentState(s string) string {
+	switch s {
+	case "error", "missingFiles", "unknown":
+		return TorrentError
+	case "uploading", "stalledUP", "forcedUP":
+		return TorrentSeeding
+	case "pausedUP", "stoppedUP":
+		return TorrentCompleted
+	case "pausedDL", "stoppedDL":
+		return TorrentPaused
+	case "queuedUP", "queuedDL":
+		return TorrentQueued
+	case "checkingUP", "checkingDL", "checkingResumeData", "moving":
+		return TorrentChecking
+	}
+	return TorrentDownloading
+}
+
+func (q *qbittorrent) List(ctx context.Context) ([]*Torrent, error) {
+	var list []struct {
+		Hash        string  `json:"hash"`
+		Name        string  `json:"name"`
+		SavePath    string  `json:"save_path"`
+		ContentPath string  `json:"content_path"`
+		State       string  `json:"state"`
+		Progress    float64 `json:"progress"`
+		Ratio       float64 `json:"ratio"`
+		Size        int64   `json:"size"`
+		DlSpeed     int64   `json:"dlspeed"`
+		UpSpeed     int64   `json:"upspeed"`
+		ETA         int64   `json:"eta"`
+	}
+	if err := q.call(ctx, "torrents/info", url.Values{}, &list); err != nil {
+		return nil, err
+	}
+	out := make([]*Torrent, 0, len(list))
+	for _, v := range list {
+		t := &Torrent{
+			Hash:        v.Hash,
+			Name:        v.Name,
+			State:       qbittorrentState(v.State),
+			Progress:    v.Progress,
+			Ratio:       v.Ratio,
+			Size:        v.Size,
+			DlSpeed:     v.DlSpeed,
+			UpSpeed:     v.UpSpeed,
+			ETA:         v.ETA,
+			contentPath: v.ContentPath,
+		}
+		// content_path since 4.3.2
+		if len(t.contentPath) == 0 {
+			t.contentPath = filepath.Join(v.SavePath, v.Name)
+		}
+		// eta of finished torrent is 8640000
+		if t.ETA >= 8640000 {
+			t.ETA = -1
+		}
+		if t.State == TorrentError {
+			t.Error = v.State
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// action call endpoint, fallback to name of qbittorrent 5 if not found
+func (q *qbittorrent) action(ctx context.Context, endpoint, v5 string, form url.Values) error {
+	err := q.call(ctx, "torrents/"+endpoint, form, nil)
+	if errors.Is(err, errNotFound) {
+		err = q.call(ctx, "torrents/"+v5, form, nil)
+	}
+	return err
+}
+
+func (q *qbittorrent) Pause(ctx context.Context, hash string) error {
+	return q.action(ctx, "pause", "stop", url.Values{"hashes": {hash}})
+}
+
+func (q *qbittorrent) Resume(ctx context.Context, hash string) error {
+	return q.action(ctx, "resume", "start", url.Values{"hashes": {hash}})
+}
+
+func (q *qbittorrent) Remove(ctx context.Context, hash string, deleteFiles bool) error {
+	form := url.Values{"hashes": {hash}, "deleteFiles": {fmt.Sprint(deleteFiles)}}
+	return q.call(ctx, "torrents/delete", form, nil)
+}
+
+func (q *qbittorrent) Add(ctx context.Context, t *TorrentAdd) error {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("savepath", t.SavePath)
+	if len(t.Magnet) > 0 {
+		w.WriteField("urls", t.Magnet)
+	} else {
+		f, err := w.CreateFormFile("torrents", t.Hash+".torrent")
+		if err != nil {
+			return err
+		}
+		f.Write(t.File)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	b, err := q.post(ctx, "torrents/add", w.FormDataContentType(), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if s := strings.TrimSpace(string(b)); s != "Ok." {
+		return fmt.Errorf("qbittorrent add: %s", s)
+	}
+	return nil
+}
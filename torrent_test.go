@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubQbittorrent is qbittorrent api accept cookie SID of last login,
+// torrents/pause is 404 like qbittorrent 5
+type stubQbittorrent struct {
+	mu     sync.Mutex
+	sid    string
+	logins int
+	calls  []string
+}
+
+func (s *stubQbittorrent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	endpoint := strings.TrimPrefix(r.URL.Path, "/api/v2/")
+	if endpoint == "auth/login" {
+		r.ParseForm()
+		if r.Form.Get("username") != "admin" || r.Form.Get("password") != "pw" {
+			fmt.Fprint(w, "Fails.")
+			return
+		}
+		s.logins++
+		s.sid = fmt.Sprint("sid", s.logins)
+		http.SetCookie(w, &http.Cookie{Name: "SID", Value: s.sid, Path: "/"})
+		fmt.Fprint(w, "Ok.")
+		return
+	}
+	if c, err := r.Cookie("SID"); err != nil || c.Value != s.sid || len(s.sid) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.calls = append(s.calls, endpoint)
+	switch endpoint {
+	case "torrents/info":
+		json.NewEncoder(w).Encode([]map[string]interface{}{
+			{"hash": "aa", "name": "a", "save_path": "/downloads", "content_path": "/downloads/a", "state": "stalledUP", "progress": 1, "eta": 8640000},
+			{"hash": "bb", "name": "b", "save_path": "/downloads/tv", "state": "downloading", "progress": 0.5, "eta": 60},
+		})
+	case "torrents/stop", "torrents/resume", "torrents/delete":
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestQbittorrent(t *testing.T) (*qbittorrent, *stubQbittorrent) {
+	t.Helper()
+	stub := new(stubQbittorrent)
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("admin", "pw")
+	return newQbittorrent(u), stub
+}
+
+func TestQbittorrentLogin(t *testing.T) {
+	q, stub := newTestQbittorrent(t)
+	ctx := context.Background()
+	list, err := q.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.logins != 1 {
+		t.Errorf("logins = %d, want 1", stub.logins)
+	}
+	if len(list) != 2 {
+		t.Fatalf("len(list) = %d, want 2", len(list))
+	}
+	if a := list[0]; a.State != TorrentSeeding || a.ETA != -1 || a.contentPath != "/downloads/a" {
+		t.Errorf("torrent a = %+v", a)
+	}
+	// content_path missing before 4.3.2
+	if b := list[1]; b.State != TorrentDownloading || b.contentPath != "/downloads/tv/b" {
+		t.Errorf("torrent b = %+v", b)
+	}
+	// cookie reused
+	if _, err := q.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stub.logins != 1 {
+		t.Errorf("logins = %d after second call, want 1", stub.logins)
+	}
+	// session expired, login again once
+	stub.mu.Lock()
+	stub.sid = "expired"
+	stub.mu.Unlock()
+	if _, err := q.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stub.logins != 2 {
+		t.Errorf("logins = %d after expire, want 2", stub.logins)
+	}
+}
+
+func TestQbittorrentLoginFailed(t *testing.T) {
+	stub := new(stubQbittorrent)
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("admin", "wrong")
+	if _, err := newQbittorrent(u).List(context.Background()); err == nil {
+		t.Error("want error of wrong password")
+	}
+}
+
+func TestQbittorrentActionFallback(t *testing.T) {
+	q, stub := newTestQbittorrent(t)
+	if err := q.Pause(context.Background(), "aa"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"torrents/pause", "torrents/stop"}
+	if strings.Join(stub.calls, ",") != strings.Join(want, ",") {
+		t.Errorf("calls = %v, want %v", stub.calls, want)
+	}
+}
+
+// stubTransmission is transmission rpc require session id it issued
+type stubTransmission struct {
+	mu        sync.Mutex
+	session   string
+	conflicts int
+	methods   []string
+}
+
+func (s *stubTransmission) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, pass, _ := r.BasicAuth(); user != "admin" || pass != "pw" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("X-Transmission-Session-Id") != s.session {
+		s.conflicts++
+		w.Header().Set("X-Transmission-Session-Id", s.session)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	b, _ := io.ReadAll(r.Body)
+	var req struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal(b, &req)
+	s.methods = append(s.methods, req.Method)
+	switch req.Method {
+	case "torrent-get":
+		fmt.Fprint(w, `{"result":"success","arguments":{"torrents":[
+			{"hashString":"aa","name":"a","downloadDir":"/downloads","status":6,"percentDone":1,"uploadRatio":-1,"eta":-1},
+			{"hashString":"bb","name":"b","downloadDir":"/downloads","status":0,"percentDone":0.3,"eta":-2,"error":3,"errorString":"no space"}]}}`)
+	default:
+		fmt.Fprint(w, `{"result":"success","arguments":{}}`)
+	}
+}
+
+func TestTransmissionSession(t *testing.T) {
+	stub := &stubTransmission{session: "s1"}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	u.User = url.UserPassword("admin", "pw")
+	tr := newTransmission(u)
+	ctx := context.Background()
+	list, err := tr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.conflicts != 1 {
+		t.Errorf("conflicts = %d, want 1", stub.conflicts)
+	}
+	if len(list) != 2 {
+		t.Fatalf("len(list) = %d, want 2", len(list))
+	}
+	if a := list[0]; a.State != TorrentSeeding || a.Ratio != 0 || a.contentPath != "/downloads/a" {
+		t.Errorf("torrent a = %+v", a)
+	}
+	if b := list[1]; b.State != TorrentError || b.Error != "no space" || b.ETA != -1 {
+		t.Errorf("torrent b = %+v", b)
+	}
+	// session id reused
+	if err := tr.Pause(ctx, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	if stub.conflicts != 1 {
+		t.Errorf("conflicts = %d after second call, want 1", stub.conflicts)
+	}
+	// session renewed by server
+	stub.mu.Lock()
+	stub.session = "s2"
+	stub.mu.Unlock()
+	if err := tr.Resume(ctx, "aa"); err != nil {
+		t.Fatal(err)
+	}
+	if stub.conflicts != 2 {
+		t.Errorf("conflicts = %d after renew, want 2", stub.conflicts)
+	}
+	want := "torrent-get,torrent-stop,torrent-start"
+	if got := strings.Join(stub.methods, ","); got != want {
+		t.Errorf("methods = %s, want %s", got, want)
+	}
+}
+
+func TestTorrentState(t *testing.T) {
+	qb := map[string]string{
+		"downloading":        TorrentDownloading,
+		"stalledDL":          TorrentDownloading,
+		"metaDL":             TorrentDownloading,
+		"uploading":          TorrentSeeding,
+		"stalledUP":          TorrentSeeding,
+		"forcedUP":           TorrentSeeding,
+		"pausedUP":           TorrentCompleted,
+		"stoppedUP":          TorrentCompleted,
+		"pausedDL":           TorrentPaused,
+		"stoppedDL":          TorrentPaused,
+		"queuedDL":           TorrentQueued,
+		"checkingResumeData": TorrentChecking,
+		"missingFiles":       TorrentError,
+		"error":              TorrentError,
+	}
+	for in, want := range qb {
+		if got := qbittorrentState(in); got != want {
+			t.Errorf("qbittorrentState(%q) = %q, want %q", in, got, want)
+		}
+	}
+	tr := []struct {
+		status int
+		done   float64
+		want   string
+	}{
+		{0, 0.5, TorrentPaused},
+		{0, 1, TorrentCompleted},
+		{1, 0, TorrentChecking},
+		{2, 0, TorrentChecking},
+		{3, 0, TorrentQueued},
+		{4, 0.5, TorrentDownloading},
+		{5, 1, TorrentQueued},
+		{6, 1, TorrentSeeding},
+	}
+	for _, c := range tr {
+		if got := transmissionState(c.status, c.done); got != c.want {
+			t.Errorf("transmissionState(%d, %v) = %q, want %q", c.status, c.done, got, c.want)
+		}
+	}
+}
+
+func TestTorrentToRoot(t *testing.T) {
+	oldRoot := rootDir
+	defer func() { rootDir = oldRoot }()
+	rootDir = "/data"
+	cases := []struct {
+		m    string
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "/data/tv/a", "tv/a", true},
+		{"", "/data", ".", true},
+		{"", "/data2/a", "", false},
+		{"", "/other/a", "", false},
+		{"/downloads:/", "/downloads/a", "a", true},
+		{"/downloads:/", "/downloads/tv/../a", "a", true},
+		{"/downloads:/", "/downloads/../etc/passwd", "", false},
+		{"/downloads:/", "/downloads2/a", "", false},
+		{"/downloads:/media/dl", "/downloads/tv/b", "media/dl/tv/b", true},
+		{"/downloads/:/media/dl/", "/downloads/b", "media/dl/b", true},
+	}
+	for _, c := range cases {
+		tc := &TorrentClient{Type: "qbittorrent", URL: "http://127.0.0.1:8080", Map: c.m}
+		if err := tc.init(); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := tc.toRoot(c.in)
+		if ok != c.ok || got != c.want {
+			t.Errorf("map %q toRoot(%q) = %q, %v, want %q, %v", c.m, c.in, got, ok, c.want, c.ok)
+		}
+	}
+	for _, m := range []string{"downloads:/", "/downloads"} {
+		tc := &TorrentClient{Type: "qbittorrent", URL: "http://127.0.0.1:8080", Map: m}
+		if err := tc.init(); err == nil {
+			t.Errorf("map %q should be invalid", m)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// transmission is client of transmission rpc
+type transmission struct {
+	url     string
+	user    string
+	pass    string
+	client  *http.Client
+	mu      sync.Mutex
+	session string // X-Transmission-Session-Id, renewed on 409
+}
+
+func newTransmission(u *url.URL) *transmission {
+	t := &transmission{user: u.User.Username()}
+	t.pass, _ = u.User.Password()
+	b := *u
+	b.User = nil
+	if len(b.Path) == 0 || b.Path == "/" {
+		b.Path = "/transmission/rpc"
+	}
+	t.url = b.String()
+	t.client = &http.Client{Timeout: 30 * time.Second}
+	return t
+}
+
+// rpc call method, retry once with new session id on 409
+func (t *transmission) rpc(ctx context.Context, method string, args, out interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"method": method, "arguments": args})
+	if err != nil {
+		return err
+	}
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		t.mu.Lock()
+		req.Header.Set("X-Transmission-Session-Id", t.session)
+		t.mu.Unlock()
+		if len(t.user) > 0 {
+			req.SetBasicAuth(t.user, t.pass)
+		}
+		resp, err := t.client.Do(req)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusConflict && retry == 0 {
+			t.mu.Lock()
+			t.session = resp.Header.Get("X-Transmission-Session-Id")
+			t.mu.Unlock()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("transmission %s: %d %s", method, resp.StatusCode, b)
+		}
+		var res struct {
+			Result    string          `json:"result"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(b, &res); err != nil {
+			return err
+		}
+		if res.Result != "success" {
+			return fmt.Errorf("transmission %s: %s", method, res.Result)
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(res.Arguments, out)
+	}
+}
+
+// transmissionState map status of transmission to normalized state
+func transmissionState(status int, done float64) string {
+	switch status {
+	case 0:
+		if done >= 1 {
+			return TorrentCompleted
+		}
+		return TorrentPaused
+	case 1, 2:
+		return TorrentChecking
+	case 3, 5:
+		return TorrentQueued
+	case 6:
+		return TorrentSeeding
+	}
+	return TorrentDownloading
+}
+
+func (t *transmission) List(ctx context.Context) ([]*Torrent, error) {
+	var res struct {
+		Torrents []struct {
+			HashString   string  `json:"hashString"`
+			Name         string  `json:"name"`
+			DownloadDir  string  `json:"downloadDir"`
+			Status       int     `json:"status"`
+			PercentDone  float64 `json:"percentDone"`
+			UploadRatio  float64 `json:"uploadRatio"`
+			TotalSize    int64   `json:"totalSize"`
+			RateDownload int64   `json:"rateDownload"`
+			RateUpload   int64   `json:"rateUpload"`
+			ETA          int64   `json:"eta"`
+			Error        int     `json:"error"`
+			ErrorString  string  `json:"errorString"`
+		} `json:"torrents"`
+	}
+	args := map[string]interface{}{
+		"fields": []string{"hashString", "name", "downloadDir", "status", "percentDone", "uploadRatio",
+			"totalSize", "rateDownload", "rateUpload", "eta", "error", "errorString"},
+	}
+	if err := t.rpc(ctx, "torrent-get", args, &res); err != nil {
+		return nil, err
+	}
+	out := make([]*Torrent, 0, len(res.Torrents))
+	for _, v := range res.Torrents {
+		tr := &Torrent{
+			Hash:        v.HashString,
+			Name:        v.Name,
+			State:       transmissionState(v.Status, v.PercentDone),
+			Progress:    v.PercentDone,
+			Ratio:       v.UploadRatio,
+			Size:        v.TotalSize,
+			DlSpeed:     v.RateDownload,
+			UpSpeed:     v.RateUpload,
+			ETA:         v.ETA,
+			contentPath: filepath.Join(v.DownloadDir, v.Name),
+		}
+		// ratio and eta of transmission is -1 or -2 if not available
+		if tr.Ratio < 0 {
+			tr.Ratio = 0
+		}
+		if tr.ETA < 0 {
+			tr.ETA = -1
+		}
+		if v.Error != 0 {
+			tr.State = TorrentError
+			tr.Error = v.ErrorString
+		}
+		out = append(out, tr)
+	}
+	return out, nil
+}
+
+func (t *transmission) Pause(ctx context.Context, hash string) error {
+	return t.rpc(ctx, "torrent-stop", map[string]interface{}{"ids": []string{hash}}, nil)
+}
+
+func (t *transmission) Resume(ctx context.Context, hash string) error {
+	return t.rpc(ctx, "torrent-start", map[string]interface{}{"ids": []string{hash}}, nil)
+}
+
+func (t *transmission) Remove(ctx context.Context, hash string, deleteFiles bool) error {
+	args := map[string]interface{}{"ids": []string{hash}, "delete-local-data": deleteFiles}
+	return t.rpc(ctx, "torrent-remove", args, nil)
+}
+
+func (t *transmission) Add(ctx context.Context, a *TorrentAdd) error {
+	args := map[string]interface{}{"download-dir": a.SavePath}
+	if len(a.Magnet) > 0 {
+		args["filename"] = a.Magnet
+	} else {
+		args["metainfo"] = base64.StdEncoding.EncodeToString(a.File)
+	}
+	return t.rpc(ctx, "torrent-add", args, nil)
+}